@@ -17,26 +17,199 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package v1alpha1
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strings"
 	"time"
 
 	"github.com/jedib0t/go-pretty/v6/table"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/duration"
 )
 
+const (
+	BackupStorageS3         = "s3"
+	BackupStorageFilesystem = "filesystem"
+
+	// VerifyAnnotation requests checksum verification of stored backup,
+	// every new value of annotation triggers verification once
+	VerifyAnnotation = "verify.operator.etcd.io"
+
+	// StorageFinalizer removes stored snapshot on backup deletion
+	StorageFinalizer = "storage.operator.etcd.io"
+
+	// BackupVerified is a condition type of backup restored by verification
+	// job, also it is a condition type of cluster which latest verified
+	// backup is restorable
+	BackupVerified = "Verified"
+
+	DefaultBackupMaxAttempts = 5
+	DefaultBackupDeadline    = time.Hour
+
+	// VerificationDeadline limits duration of restore verification job, job
+	// exceeding it is failed by kubernetes
+	VerificationDeadline = time.Hour
+
+	// maxJobNameLength keeps name of job pods get in job-name label valid
+	maxJobNameLength = 63
+)
+
+// SnapshotSource defines member backup snapshot is taken from
+type SnapshotSource string
+
+var (
+	// SnapshotSourcePreferFollower selects the most caught up follower and
+	// falls back to leader if there are no such followers
+	SnapshotSourcePreferFollower SnapshotSource = "PreferFollower"
+	// SnapshotSourceFollower selects the most caught up follower only
+	SnapshotSourceFollower SnapshotSource = "Follower"
+	SnapshotSourceLeader   SnapshotSource = "Leader"
+	// SnapshotSourceAny selects the first healthy member
+	SnapshotSourceAny SnapshotSource = "Any"
+)
+
+// BackupType defines format of stored backup
+type BackupType string
+
+var (
+	// BackupTypeSnapshot is binary etcd snapshot restorable as a whole
+	// cluster only
+	BackupTypeSnapshot BackupType = "Snapshot"
+	// BackupTypeExport is logical export of keyspace prefixes which could be
+	// imported into any cluster
+	BackupTypeExport BackupType = "Export"
+)
+
+// BackupPhase defines lifecycle of backup
+type BackupPhase string
+
+var (
+	BackupPending   BackupPhase = "Pending"
+	BackupRunning   BackupPhase = "Running"
+	BackupSucceeded BackupPhase = "Succeeded"
+	BackupFailed    BackupPhase = "Failed"
+)
+
+// Reasons of backup attempt failures
+const (
+	BackupReasonClusterNotFound   = "ClusterNotFound"
+	BackupReasonStorageFailed     = "StorageUnavailable"
+	BackupReasonSnapshotFailed    = "SnapshotFailed"
+	BackupReasonEncodingFailed    = "EncodingFailed"
+	BackupReasonUploadFailed      = "UploadFailed"
+	BackupReasonDeadlineExceeded  = "DeadlineExceeded"
+	BackupReasonAttemptsExhausted = "AttemptsExhausted"
+)
+
 // BackupSpec defines the desired state of Backup
 type BackupSpec struct {
-	RetentionPeriod time.Duration `json:"retentionPeriod,omitempty"`
+	// RetentionPeriod is time since creation backup is kept for, backup is
+	// kept until removed by schedule retention policy if it is not set
+	RetentionPeriod time.Duration   `json:"retentionPeriod,omitempty"`
+	Storage         string          `json:"storage,omitempty"`
+	StorageLocation string          `json:"storageLocation,omitempty"`
+	Compression     string          `json:"compression,omitempty"`
+	Encryption      *EncryptionSpec `json:"encryption,omitempty"`
+	// MaxAttempts limits number of snapshot and upload attempts
+	MaxAttempts int `json:"maxAttempts,omitempty"`
+	// Deadline limits time since backup creation to finish it
+	Deadline time.Duration `json:"deadline,omitempty"`
+	// RetainOnDelete keeps stored snapshot when backup is deleted
+	RetainOnDelete bool `json:"retainOnDelete,omitempty"`
+	// Imported backup is created from snapshot found in storage, it is
+	// never taken again and ignored by schedule retention policies
+	Imported bool `json:"imported,omitempty"`
+	// VerifyRestore enables restoration of backup into scratch directory by
+	// verification job after upload
+	VerifyRestore bool `json:"verifyRestore,omitempty"`
+	// VerifyPeriod is period of repeated restore verification, backup is
+	// verified once if it is not set
+	VerifyPeriod time.Duration `json:"verifyPeriod,omitempty"`
+	// Source is member snapshot is taken from, default is PreferFollower
+	// +kubebuilder:validation:Enum=PreferFollower;Follower;Leader;Any
+	Source SnapshotSource `json:"source,omitempty"`
+	// Type is format of backup, default is Snapshot
+	// +kubebuilder:validation:Enum=Snapshot;Export
+	Type BackupType `json:"type,omitempty"`
+	// Prefixes are key prefixes included into export backup, whole keyspace
+	// is exported if they are not set
+	Prefixes []string `json:"prefixes,omitempty"`
+	// Replicas are names of BackupStorageLocations stored backup is copied
+	// to after upload
+	Replicas []string `json:"replicas,omitempty"`
+}
+
+// EncryptionSpec defines client-side encryption of backup snapshots. Every
+// data key of referenced secret is 32 bytes AES-256 key named by its key ID,
+// so keys could be rotated by adding new one and changing KeyID, while old
+// backups stay restorable until their keys are removed from secret
+type EncryptionSpec struct {
+	KeySecret string `json:"keySecret"`
+	KeyID     string `json:"keyID"`
 }
 
 // BackupStatus defines the observed state of Backup
 type BackupStatus struct {
-	Finished metav1.Time `json:"finishedTime,omitempty"`
+	Phase       BackupPhase `json:"phase,omitempty"`
+	Reason      string      `json:"reason,omitempty"`
+	Message     string      `json:"message,omitempty"`
+	Attempts    int         `json:"attempts,omitempty"`
+	LastAttempt metav1.Time `json:"lastAttemptTime,omitempty"`
+	Finished    metav1.Time `json:"finishedTime,omitempty"`
+	URL         string      `json:"url,omitempty"`
+	Compression string      `json:"compression,omitempty"`
+	Size        int64       `json:"size,omitempty"`
+	RawSize     int64       `json:"rawSize,omitempty"`
+	// EncryptionKeyID is ID of key snapshot is encrypted with
+	EncryptionKeyID string `json:"encryptionKeyID,omitempty"`
+	// Checksum is hex encoded SHA-256 of stored object
+	Checksum    string `json:"checksum,omitempty"`
+	Revision    int64  `json:"revision,omitempty"`
+	EtcdVersion string `json:"etcdVersion,omitempty"`
+	Member      string `json:"member,omitempty"`
+	// History is history of cluster revisions snapshot belongs to, only
+	// journal of the same history could be replayed onto it
+	History string `json:"history,omitempty"`
+
+	VerifyRequest string      `json:"verifyRequest,omitempty"`
+	Verified      metav1.Time `json:"verifiedTime,omitempty"`
+	VerifyError   string      `json:"verifyError,omitempty"`
+
+	// SnapshotHash is hash of snapshot computed on upload the same way
+	// etcdctl snapshot status does, restore verification compares with it
+	SnapshotHash int64 `json:"snapshotHash,omitempty"`
+	// SnapshotRevision is revision of snapshot computed on upload. Revision
+	// is recorded before snapshot is streamed, so snapshot could contain
+	// later revisions
+	SnapshotRevision     int64              `json:"snapshotRevision,omitempty"`
+	VerificationJob      string             `json:"verificationJob,omitempty"`
+	LastVerificationTime metav1.Time        `json:"lastVerificationTime,omitempty"`
+	Conditions           []metav1.Condition `json:"conditions,omitempty"`
+
+	Replicas []ReplicaStatus `json:"replicas,omitempty"`
+	// RetainUntil is time stored snapshot and its copies are locked against
+	// deletion until
+	RetainUntil metav1.Time `json:"retainUntil,omitempty"`
+}
+
+// ReplicaStatus defines the observed state of backup copy in replica storage
+// location
+type ReplicaStatus struct {
+	Location string      `json:"location"`
+	Phase    BackupPhase `json:"phase,omitempty"`
+	Message  string      `json:"message,omitempty"`
 	URL      string      `json:"url,omitempty"`
+	Finished metav1.Time `json:"finishedTime,omitempty"`
 }
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Status",type=string,JSONPath=`.status.phase`
+//+kubebuilder:printcolumn:name="Reason",type=string,JSONPath=`.status.reason`
 
 // Backup is the Schema for the backups API
 type Backup struct {
@@ -47,13 +220,292 @@ type Backup struct {
 	Status BackupStatus `json:"status,omitempty"`
 }
 
+// GetSnapshotTime returns time snapshot of backup was started to be taken
+// at, changes made later are not included into it. Imported backups and
+// backups created before attempts were recorded have only finished time
+func (in Backup) GetSnapshotTime() metav1.Time {
+	if !in.Status.LastAttempt.IsZero() {
+		return in.Status.LastAttempt
+	}
+
+	return in.Status.Finished
+}
+
+// IsFinished returns true if backup either succeeded or failed. Backups
+// created before phases were introduced have only finished time
+func (in Backup) IsFinished() bool {
+	return in.Status.Phase == BackupSucceeded || in.Status.Phase == BackupFailed ||
+		(in.Status.Phase == "" && !in.Status.Finished.IsZero())
+}
+
+// IsSucceeded returns true if backup snapshot is stored
+func (in Backup) IsSucceeded() bool {
+	return in.Status.Phase == BackupSucceeded || (in.Status.Phase == "" && !in.Status.Finished.IsZero())
+}
+
+func (in Backup) GetMaxAttempts() int {
+	if in.Spec.MaxAttempts > 0 {
+		return in.Spec.MaxAttempts
+	}
+
+	return DefaultBackupMaxAttempts
+}
+
+func (in Backup) GetDeadline() time.Time {
+	deadline := in.Spec.Deadline
+	if deadline <= 0 {
+		deadline = DefaultBackupDeadline
+	}
+
+	return in.CreationTimestamp.Add(deadline)
+}
+
+// GetBackoff returns delay before the next attempt, it doubles after each
+// failed attempt starting from ten seconds and is capped by ten minutes
+func (in Backup) GetBackoff() time.Duration {
+	backoff := 10 * time.Second
+	for attempt := 1; attempt < in.Status.Attempts && backoff < 10*time.Minute; attempt++ {
+		backoff *= 2
+	}
+	if backoff > 10*time.Minute {
+		backoff = 10 * time.Minute
+	}
+
+	return backoff
+}
+
+func (in *Backup) SetSucceeded() {
+	in.Status.Phase = BackupSucceeded
+	in.Status.Reason = ""
+	in.Status.Message = ""
+	in.Status.Finished = metav1.Now()
+}
+
+func (in *Backup) SetFailed(reason, message string) {
+	in.Status.Phase = BackupFailed
+	in.Status.Reason = reason
+	in.Status.Message = message
+	in.Status.Finished = metav1.Now()
+}
+
+// GetReplicaStatus returns status of backup copy in replica location, it is
+// added if it is missing
+func (in *Backup) GetReplicaStatus(location string) *ReplicaStatus {
+	for i := range in.Status.Replicas {
+		if in.Status.Replicas[i].Location == location {
+			return &in.Status.Replicas[i]
+		}
+	}
+
+	in.Status.Replicas = append(in.Status.Replicas, ReplicaStatus{
+		Location: location,
+		Phase:    BackupPending,
+	})
+
+	return &in.Status.Replicas[len(in.Status.Replicas)-1]
+}
+
+// Lock extends time stored backup is locked against deletion until
+func (in *Backup) Lock(until time.Time) {
+	if until.After(in.Status.RetainUntil.Time) {
+		in.Status.RetainUntil = metav1.NewTime(until)
+	}
+}
+
+// IsLocked returns true if stored backup couldn't be removed yet
+func (in Backup) IsLocked() bool {
+	return in.Status.RetainUntil.After(time.Now())
+}
+
+// HasReplica returns true if backup is copied to location
+func (in Backup) HasReplica(location string) bool {
+	for _, replica := range in.Spec.Replicas {
+		if replica == location {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetCompression returns compression codec of stored snapshot, it could be
+// specified for imported backups as it is undetectable for encrypted ones
+func (in Backup) GetCompression() string {
+	if in.Spec.Imported && in.Spec.Compression != "" {
+		return in.Spec.Compression
+	}
+
+	return in.Status.Compression
+}
+
+// GetEncryptionKeyID returns ID of key stored snapshot is encrypted with,
+// it could be specified for imported backups
+func (in Backup) GetEncryptionKeyID() string {
+	if in.Status.EncryptionKeyID == "" && in.Spec.Imported && in.Spec.Encryption != nil {
+		return in.Spec.Encryption.KeyID
+	}
+
+	return in.Status.EncryptionKeyID
+}
+
+// GetType returns format of backup
+func (in Backup) GetType() BackupType {
+	if in.Spec.Type == "" {
+		return BackupTypeSnapshot
+	}
+
+	return in.Spec.Type
+}
+
+// ShouldVerifyRestore returns true if backup restore verification is due,
+// export backups are never verified by restore
+func (in Backup) ShouldVerifyRestore() bool {
+	if !in.Spec.VerifyRestore || !in.IsSucceeded() || in.GetType() != BackupTypeSnapshot {
+		return false
+	}
+	if in.Status.LastVerificationTime.IsZero() {
+		return true
+	}
+
+	return in.Spec.VerifyPeriod > 0 && time.Since(in.Status.LastVerificationTime.Time) >= in.Spec.VerifyPeriod
+}
+
+// GetVerificationJob returns job which restores backup snapshot into scratch
+// directory and reports snapshot status. Fetch container is added separately
+func (in Backup) GetVerificationJob(name, version string) *batchv1.Job {
+	var backoffLimit int32
+	deadline := int64(VerificationDeadline.Seconds())
+	snapshotPath := in.GetVerificationSnapshotPath()
+
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: in.Namespace,
+			Labels: map[string]string{
+				ClusterLabel: in.Labels[ClusterLabel],
+			},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit:          &backoffLimit,
+			ActiveDeadlineSeconds: &deadline,
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					InitContainers: []corev1.Container{{
+						Name:                     RestoreContainerName,
+						Image:                    fmt.Sprintf("quay.io/coreos/etcd:v%s", version),
+						TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError,
+						Command: []string{
+							"/usr/local/bin/etcdctl",
+						},
+						Args: []string{
+							"snapshot",
+							"restore",
+							snapshotPath,
+							"--data-dir", path.Join(verificationScratchMount.MountPath, "data"),
+						},
+						VolumeMounts: []corev1.VolumeMount{
+							verificationSnapshotMount,
+							verificationScratchMount,
+						},
+					}},
+					Containers: []corev1.Container{{
+						Name:                     VerifyContainerName,
+						Image:                    fmt.Sprintf("quay.io/coreos/etcd:v%s", version),
+						TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError,
+						Command: []string{
+							"/usr/local/bin/etcdctl",
+						},
+						Args: []string{
+							"snapshot",
+							"status",
+							snapshotPath,
+							"--write-out", "json",
+						},
+						VolumeMounts: []corev1.VolumeMount{
+							verificationSnapshotMount,
+						},
+					}},
+					Volumes: []corev1.Volume{{
+						Name: verificationSnapshotMount.Name,
+						VolumeSource: corev1.VolumeSource{
+							EmptyDir: &corev1.EmptyDirVolumeSource{},
+						},
+					}, {
+						Name: verificationScratchMount.Name,
+						VolumeSource: corev1.VolumeSource{
+							EmptyDir: &corev1.EmptyDirVolumeSource{},
+						},
+					}},
+				},
+			},
+		},
+	}
+}
+
+// GetVerificationJobName returns name of verification job started at given
+// time, long backup names are truncated and suffixed by their hash to fit
+// into label value
+func (in Backup) GetVerificationJobName(started time.Time) string {
+	suffix := fmt.Sprintf("-verify-%d", started.Unix())
+	name := in.Name
+	if len(name)+len(suffix) > maxJobNameLength {
+		hash := sha256.Sum256([]byte(in.Name))
+		hashSuffix := "-" + hex.EncodeToString(hash[:])[:8]
+		name = strings.TrimRight(name[:maxJobNameLength-len(suffix)-len(hashSuffix)], "-.") + hashSuffix
+	}
+
+	return name + suffix
+}
+
+// GetVerificationSnapshotMount returns volume mount snapshot is downloaded
+// into by verification job
+func (in Backup) GetVerificationSnapshotMount() corev1.VolumeMount {
+	return verificationSnapshotMount
+}
+
+func (in Backup) GetVerificationSnapshotPath() string {
+	return path.Join(verificationSnapshotMount.MountPath, "snapshot.db")
+}
+
+var (
+	verificationSnapshotMount = corev1.VolumeMount{
+		Name:      "snapshot",
+		MountPath: "/var/lib/snapshot",
+	}
+	verificationScratchMount = corev1.VolumeMount{
+		Name:      "scratch",
+		MountPath: "/var/lib/scratch",
+	}
+)
+
+// GetStorageKey returns key of backup snapshot inside backup storage
+func (in Backup) GetStorageKey() string {
+	return path.Join(in.Labels[ClusterLabel], in.Name)
+}
+
 type PrettyBackup struct {
 	Name            string `json:"name,omitempty" yaml:"name,omitempty"`
 	Namespace       string `json:"namespace,omitempty" yaml:"namespace,omitempty"`
 	Cluster         string `json:"cluster,omitempty" yaml:"cluster,omitempty"`
+	Type            string `json:"type,omitempty" yaml:"type,omitempty"`
+	Phase           string `json:"phase,omitempty" yaml:"phase,omitempty"`
+	Reason          string `json:"reason,omitempty" yaml:"reason,omitempty"`
+	Message         string `json:"message,omitempty" yaml:"message,omitempty"`
+	Attempts        int    `json:"attempts,omitempty" yaml:"attempts,omitempty"`
 	RetentionPeriod string `json:"retentionPeriod,omitempty" yaml:"retentionPeriod,omitempty"`
 	Finished        string `json:"finished,omitempty" yaml:"finished,omitempty"`
 	URL             string `json:"url,omitempty" yaml:"url,omitempty"`
+	Compression     string `json:"compression,omitempty" yaml:"compression,omitempty"`
+	Size            int64  `json:"size,omitempty" yaml:"size,omitempty"`
+	RawSize         int64  `json:"rawSize,omitempty" yaml:"rawSize,omitempty"`
+	EncryptionKeyID string `json:"encryptionKeyID,omitempty" yaml:"encryptionKeyID,omitempty"`
+	Checksum        string `json:"checksum,omitempty" yaml:"checksum,omitempty"`
+	Revision        int64  `json:"revision,omitempty" yaml:"revision,omitempty"`
+	EtcdVersion     string `json:"etcdVersion,omitempty" yaml:"etcdVersion,omitempty"`
+	Member          string `json:"member,omitempty" yaml:"member,omitempty"`
+	Verified        string `json:"verified,omitempty" yaml:"verified,omitempty"`
+	VerifyError     string `json:"verifyError,omitempty" yaml:"verifyError,omitempty"`
 }
 
 func (in Backup) Prettify() interface{} {
@@ -61,12 +513,35 @@ func (in Backup) Prettify() interface{} {
 		Name:            in.Name,
 		Namespace:       in.Namespace,
 		Cluster:         in.Labels[ClusterLabel],
+		Type:            string(in.GetType()),
+		Phase:           string(in.Status.Phase),
+		Reason:          in.Status.Reason,
+		Message:         in.Status.Message,
+		Attempts:        in.Status.Attempts,
 		RetentionPeriod: duration.HumanDuration(in.Spec.RetentionPeriod),
 		Finished:        in.Status.Finished.Format("2006-01-02 15:04:05"),
 		URL:             in.Status.URL,
+		Compression:     in.Status.Compression,
+		Size:            in.Status.Size,
+		RawSize:         in.Status.RawSize,
+		EncryptionKeyID: in.Status.EncryptionKeyID,
+		Checksum:        in.Status.Checksum,
+		Revision:        in.Status.Revision,
+		EtcdVersion:     in.Status.EtcdVersion,
+		Member:          in.Status.Member,
+		Verified:        in.Status.Verified.Format("2006-01-02 15:04:05"),
+		VerifyError:     in.Status.VerifyError,
 	}
 }
 
+// VerifyRequested returns true if checksum verification is requested by
+// annotation and is not done yet
+func (in Backup) VerifyRequested() bool {
+	request := in.Annotations[VerifyAnnotation]
+
+	return request != "" && request != in.Status.VerifyRequest
+}
+
 //+kubebuilder:object:root=true
 
 // BackupList contains a list of Backup
@@ -90,6 +565,7 @@ func (in BackupList) Header() table.Row {
 	return table.Row{
 		"NAME",
 		"CLUSTER",
+		"STATUS",
 		"FINISHED AT",
 		"RETENTION",
 		"URL",
@@ -103,6 +579,7 @@ func (in BackupList) Rows() []table.Row {
 		rows = append(rows, table.Row{
 			backup.Name,
 			backup.Labels[ClusterLabel],
+			backup.Status.Phase,
 			backup.Status.Finished.Format("2006-01-02 15:04:05"),
 			duration.HumanDuration(backup.Spec.RetentionPeriod),
 			backup.Status.URL,
@@ -20,21 +20,128 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/robfig/cron/v3"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+// RunNowAnnotation requests backup creation regardless of schedule, every
+// new value of annotation triggers single backup
+const RunNowAnnotation = "run-now.operator.etcd.io"
+
+const (
+	DefaultJournalSegmentPeriod = 5 * time.Minute
+	DefaultJournalSegmentSize   = 16 * 1024 * 1024
+)
+
 // BackupScheduleSpec defines the desired state of BackupSchedule
 type BackupScheduleSpec struct {
-	CreationPeriod  time.Duration `json:"creationPeriod,omitempty"`
-	RetentionPeriod time.Duration `json:"retentionPeriod,omitempty"`
+	// Schedule is a cron expression of backup creation times, it takes
+	// precedence over CreationPeriod
+	Schedule string `json:"schedule,omitempty"`
+	// TimeZone is IANA name of Schedule time zone, default is UTC
+	TimeZone string `json:"timeZone,omitempty"`
+	// StartingDeadline is how late a missed scheduled backup could be
+	// started, missed backups are never skipped if it is not set
+	StartingDeadline time.Duration `json:"startingDeadline,omitempty"`
+	// Suspend stops scheduled backup creation, requested backups are still
+	// created
+	Suspend bool `json:"suspend,omitempty"`
+
+	CreationPeriod  time.Duration   `json:"creationPeriod,omitempty"`
+	RetentionPeriod time.Duration   `json:"retentionPeriod,omitempty"`
+	Storage         string          `json:"storage,omitempty"`
+	StorageLocation string          `json:"storageLocation,omitempty"`
+	Compression     string          `json:"compression,omitempty"`
+	Encryption      *EncryptionSpec `json:"encryption,omitempty"`
+	MaxAttempts     int             `json:"maxAttempts,omitempty"`
+	Deadline        time.Duration   `json:"deadline,omitempty"`
+	RetainOnDelete  bool            `json:"retainOnDelete,omitempty"`
+	VerifyRestore   bool            `json:"verifyRestore,omitempty"`
+	VerifyPeriod    time.Duration   `json:"verifyPeriod,omitempty"`
+	Source          SnapshotSource  `json:"source,omitempty"`
+	Type            BackupType      `json:"type,omitempty"`
+	Prefixes        []string        `json:"prefixes,omitempty"`
+	Replicas        []string        `json:"replicas,omitempty"`
+	// Retention policy replaces RetentionPeriod of created backups
+	Retention *RetentionPolicy `json:"retention,omitempty"`
+	// Journal enables continuous journal of cluster changes used for
+	// point-in-time recovery
+	Journal *JournalSpec `json:"journal,omitempty"`
+}
+
+// JournalSpec defines continuous journal of cluster changes. Journal is
+// streamed from revision of the latest backup and is stored in the same
+// storage as backups, split into segments
+type JournalSpec struct {
+	Enabled bool `json:"enabled,omitempty"`
+	// SegmentPeriod is the longest time changes are buffered before upload,
+	// it is the worst case of data loss
+	SegmentPeriod time.Duration `json:"segmentPeriod,omitempty"`
+	// SegmentSize is the largest size of uncompressed segment
+	SegmentSize int64 `json:"segmentSize,omitempty"`
+}
+
+func (in *JournalSpec) GetSegmentPeriod() time.Duration {
+	if in.SegmentPeriod > 0 {
+		return in.SegmentPeriod
+	}
+
+	return DefaultJournalSegmentPeriod
+}
+
+func (in *JournalSpec) GetSegmentSize() int64 {
+	if in.SegmentSize > 0 {
+		return in.SegmentSize
+	}
+
+	return DefaultJournalSegmentSize
+}
+
+// RetentionPolicy defines which backups of cluster are kept, backup is kept
+// if it is selected by any rule. Daily, weekly and monthly rules keep the
+// newest backup of each of the latest days, weeks and months, the newest
+// succeeded backup is never removed
+type RetentionPolicy struct {
+	KeepLast    int `json:"keepLast,omitempty"`
+	KeepDaily   int `json:"keepDaily,omitempty"`
+	KeepWeekly  int `json:"keepWeekly,omitempty"`
+	KeepMonthly int `json:"keepMonthly,omitempty"`
+}
+
+// IsEmpty returns true if policy keeps no backups by any rule, such policy
+// keeps all backups
+func (in *RetentionPolicy) IsEmpty() bool {
+	return in.KeepLast <= 0 && in.KeepDaily <= 0 && in.KeepWeekly <= 0 && in.KeepMonthly <= 0
 }
 
 // BackupScheduleStatus defines the observed state of BackupSchedule
 type BackupScheduleStatus struct {
+	LastScheduleTime     metav1.Time `json:"lastScheduleTime,omitempty"`
+	NextScheduleTime     metav1.Time `json:"nextScheduleTime,omitempty"`
+	LastSuccessfulBackup string      `json:"lastSuccessfulBackup,omitempty"`
+	LastSuccessfulTime   metav1.Time `json:"lastSuccessfulTime,omitempty"`
+	// ConsecutiveFailures is number of failed backups since the last
+	// successful one
+	ConsecutiveFailures int            `json:"consecutiveFailures,omitempty"`
+	RunNowRequest       string         `json:"runNowRequest,omitempty"`
+	Journal             *JournalStatus `json:"journal,omitempty"`
+}
+
+// JournalStatus defines the observed state of cluster journal
+type JournalStatus struct {
+	// Revision is the latest revision stored in journal
+	Revision int64 `json:"revision,omitempty"`
+	// Time is time of the latest uploaded segment
+	Time  metav1.Time `json:"time,omitempty"`
+	Error string      `json:"error,omitempty"`
 }
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Schedule",type=string,JSONPath=`.spec.schedule`
+//+kubebuilder:printcolumn:name="Suspend",type=boolean,JSONPath=`.spec.suspend`
+//+kubebuilder:printcolumn:name="Last Schedule",type=date,JSONPath=`.status.lastScheduleTime`
+//+kubebuilder:printcolumn:name="Failures",type=integer,JSONPath=`.status.consecutiveFailures`
 
 // BackupSchedule is the Schema for the backupschedules API
 type BackupSchedule struct {
@@ -45,7 +152,95 @@ type BackupSchedule struct {
 	Status BackupScheduleStatus `json:"status,omitempty"`
 }
 
+// JournalEnabled returns true if continuous journal of cluster is enabled
+func (in BackupSchedule) JournalEnabled() bool {
+	return in.Spec.Journal != nil && in.Spec.Journal.Enabled
+}
+
+// RunNowRequested returns true if backup creation is requested by annotation
+// and is not done yet
+func (in BackupSchedule) RunNowRequested() bool {
+	request := in.Annotations[RunNowAnnotation]
+
+	return request != "" && request != in.Status.RunNowRequest
+}
+
+// UpdateStatus sets the latest successful backup and number of failures since
+// it from backups of cluster
+func (in *BackupSchedule) UpdateStatus(backups []Backup) {
+	in.Status.LastSuccessfulBackup = ""
+	in.Status.LastSuccessfulTime = metav1.Time{}
+	for _, backup := range backups {
+		if backup.IsSucceeded() && !backup.Status.Finished.Before(&in.Status.LastSuccessfulTime) {
+			in.Status.LastSuccessfulBackup = backup.Name
+			in.Status.LastSuccessfulTime = backup.Status.Finished
+		}
+		if backup.CreationTimestamp.After(in.Status.LastScheduleTime.Time) {
+			in.Status.LastScheduleTime = backup.CreationTimestamp
+		}
+	}
+
+	in.Status.ConsecutiveFailures = 0
+	for _, backup := range backups {
+		if backup.Status.Phase == BackupFailed && backup.Status.Finished.After(in.Status.LastSuccessfulTime.Time) {
+			in.Status.ConsecutiveFailures++
+		}
+	}
+}
+
+// GetFailureBackoff returns delay before the next backup after failed one, it
+// doubles after each consecutive failure and never exceeds creation period
+func (in BackupSchedule) GetFailureBackoff() time.Duration {
+	backoff := time.Minute
+	for failure := 1; failure < in.Status.ConsecutiveFailures && backoff < 30*time.Minute; failure++ {
+		backoff *= 2
+	}
+	if in.Spec.CreationPeriod > 0 && backoff > in.Spec.CreationPeriod {
+		backoff = in.Spec.CreationPeriod
+	}
+
+	return backoff
+}
+
+// GetCronSchedule returns parsed cron schedule in schedule time zone
+func (in BackupSchedule) GetCronSchedule() (cron.Schedule, error) {
+	return ParseCronSchedule(in.Spec.Schedule, in.Spec.TimeZone)
+}
+
+// ParseCronSchedule parses standard cron expression which next run times are
+// computed in given time zone
+func ParseCronSchedule(schedule, timeZone string) (cron.Schedule, error) {
+	location, err := time.LoadLocation(timeZone)
+	if err != nil {
+		return nil, fmt.Errorf("unknown time zone %q: %w", timeZone, err)
+	}
+
+	parsed, err := cron.ParseStandard(schedule)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cron schedule %q: %w", schedule, err)
+	}
+
+	return zonedSchedule{
+		Schedule: parsed,
+		location: location,
+	}, nil
+}
+
+type zonedSchedule struct {
+	cron.Schedule
+	location *time.Location
+}
+
+func (s zonedSchedule) Next(t time.Time) time.Time {
+	return s.Schedule.Next(t.In(s.location))
+}
+
 func (in *BackupSchedule) GetBackup() *Backup {
+	retentionPeriod := in.Spec.RetentionPeriod
+	if in.Spec.Retention != nil {
+		retentionPeriod = 0
+	}
+
 	return &Backup{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      fmt.Sprintf("%s-%d", in.Name, time.Now().Unix()),
@@ -53,9 +248,25 @@ func (in *BackupSchedule) GetBackup() *Backup {
 			Labels: map[string]string{
 				ClusterLabel: in.Name,
 			},
+			Finalizers: []string{
+				StorageFinalizer,
+			},
 		},
 		Spec: BackupSpec{
-			RetentionPeriod: in.Spec.RetentionPeriod,
+			RetentionPeriod: retentionPeriod,
+			Storage:         in.Spec.Storage,
+			StorageLocation: in.Spec.StorageLocation,
+			Compression:     in.Spec.Compression,
+			Encryption:      in.Spec.Encryption.DeepCopy(),
+			MaxAttempts:     in.Spec.MaxAttempts,
+			Deadline:        in.Spec.Deadline,
+			RetainOnDelete:  in.Spec.RetainOnDelete,
+			VerifyRestore:   in.Spec.VerifyRestore,
+			VerifyPeriod:    in.Spec.VerifyPeriod,
+			Source:          in.Spec.Source,
+			Type:            in.Spec.Type,
+			Prefixes:        in.Spec.Prefixes,
+			Replicas:        in.Spec.Replicas,
 		},
 	}
 }
@@ -0,0 +1,111 @@
+/*
+Copyright 2022 Evgenii Omelchenko.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3.
+
+This program is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package v1alpha1
+
+import (
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// LocationAvailable is a condition type of accessible storage location
+	LocationAvailable = "Available"
+
+	// Keys of credentials secret, same as environment variables of AWS SDK
+	AccessKeyIDSecretKey     = "AWS_ACCESS_KEY_ID"
+	SecretAccessKeySecretKey = "AWS_SECRET_ACCESS_KEY"
+	SessionTokenSecretKey    = "AWS_SESSION_TOKEN"
+)
+
+// BackupStorageLocationSpec defines the desired state of BackupStorageLocation
+type BackupStorageLocationSpec struct {
+	Endpoint          string                       `json:"endpoint,omitempty"`
+	Bucket            string                       `json:"bucket"`
+	Prefix            string                       `json:"prefix,omitempty"`
+	Region            string                       `json:"region,omitempty"`
+	ForcePathStyle    bool                         `json:"forcePathStyle,omitempty"`
+	CredentialsSecret *corev1.LocalObjectReference `json:"credentialsSecret,omitempty"`
+	// DeleteOrphans removes stored snapshots without matching backups in
+	// any location sharing bucket and prefix, snapshots retained on backup
+	// deletion are kept
+	DeleteOrphans bool `json:"deleteOrphans,omitempty"`
+	// ImportBackups creates read-only backups of stored snapshots without
+	// matching backups instead of reporting or removing them
+	ImportBackups bool `json:"importBackups,omitempty"`
+	// StorageClass of uploaded objects, bucket default is used if it is
+	// not set
+	StorageClass string `json:"storageClass,omitempty"`
+	// ServerSideEncryption of uploaded objects
+	// +kubebuilder:validation:Enum=AES256;"aws:kms"
+	ServerSideEncryption string `json:"serverSideEncryption,omitempty"`
+	// KMSKeyID is ID of KMS key used by aws:kms server-side encryption
+	KMSKeyID string            `json:"kmsKeyID,omitempty"`
+	Tags     map[string]string `json:"tags,omitempty"`
+	// ObjectLock locks uploaded backups against deletion until their
+	// retention period expires
+	ObjectLock *ObjectLockSpec `json:"objectLock,omitempty"`
+}
+
+// ObjectLockSpec defines S3 Object Lock retention of uploaded backups, bucket
+// should be created with Object Lock enabled
+type ObjectLockSpec struct {
+	// +kubebuilder:validation:Enum=GOVERNANCE;COMPLIANCE
+	Mode string `json:"mode"`
+	// Retention is lock duration of backups without retention period, e.g.
+	// ones removed by schedule retention policy. They are kept until lock
+	// expires even if they are removed by policy earlier
+	Retention time.Duration `json:"retention,omitempty"`
+}
+
+// BackupStorageLocationStatus defines the observed state of BackupStorageLocation
+type BackupStorageLocationStatus struct {
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+	// OrphanedObjects are stored snapshots without matching backups found by
+	// the last scan
+	OrphanedObjects []string    `json:"orphanedObjects,omitempty"`
+	LastOrphanScan  metav1.Time `json:"lastOrphanScanTime,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Bucket",type=string,JSONPath=`.spec.bucket`
+//+kubebuilder:printcolumn:name="Prefix",type=string,JSONPath=`.spec.prefix`
+//+kubebuilder:printcolumn:name="Available",type=string,JSONPath=`.status.conditions[?(@.type=="Available")].status`
+
+// BackupStorageLocation is the Schema for the backupstoragelocations API
+type BackupStorageLocation struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   BackupStorageLocationSpec   `json:"spec,omitempty"`
+	Status BackupStorageLocationStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// BackupStorageLocationList contains a list of BackupStorageLocation
+type BackupStorageLocationList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []BackupStorageLocation `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&BackupStorageLocation{}, &BackupStorageLocationList{})
+}
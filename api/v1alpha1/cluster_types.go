@@ -26,28 +26,195 @@ import (
 	cmmeta "github.com/cert-manager/cert-manager/pkg/apis/meta/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/util/duration"
 )
 
 const (
 	ClusterLabel           = "cluster.operator.etcd.io"
 	CleanupSecretFinalizer = "cleanup-secret.operator.etcd.io"
+	// BackupFinalizer takes final backup and applies backup deletion policy
+	// on cluster deletion
+	BackupFinalizer = "backups.operator.etcd.io"
+	// FinalBackupFinalizer blocks cluster deletion until final backup is
+	// succeeded, failed final backups are taken again
+	FinalBackupFinalizer = "final-backup.operator.etcd.io"
+
+	// ForceNewClusterAnnotation requests recovery of cluster which lost
+	// quorum from its surviving member, every new value of annotation
+	// triggers single recovery
+	ForceNewClusterAnnotation = "force-new-cluster.operator.etcd.io"
+
+	DefaultRecoveryGracePeriod = 15 * time.Minute
 )
 
+// BackupDeletionPolicy defines what happens to backups of deleted cluster
+type BackupDeletionPolicy string
+
+var (
+	// BackupDeletionRetain keeps all backups of cluster
+	BackupDeletionRetain BackupDeletionPolicy = "Retain"
+	// BackupDeletionDelete removes all backups of cluster except final one
+	BackupDeletionDelete BackupDeletionPolicy = "Delete"
+	// BackupDeletionRetainLatest keeps only the latest succeeded backup
+	BackupDeletionRetainLatest BackupDeletionPolicy = "RetainLatest"
+)
+
+// PodMonitorGroupVersionKind is the prometheus-operator resource created for
+// clusters with enabled monitoring
+var PodMonitorGroupVersionKind = schema.GroupVersionKind{
+	Group:   "monitoring.coreos.com",
+	Version: "v1",
+	Kind:    "PodMonitor",
+}
+
 // ClusterSpec defines the desired state of etcd cluster
 type ClusterSpec struct {
-	Version               string        `json:"version,omitempty"`
-	Size                  int           `json:"size,omitempty"`
-	Backup                string        `json:"backup,omitempty"`
-	BackupCreationPeriod  time.Duration `json:"backupCreationPeriod,omitempty"`
-	BackupRetentionPeriod time.Duration `json:"backupRetentionPeriod,omitempty"`
+	Version                string           `json:"version,omitempty"`
+	Size                   int              `json:"size,omitempty"`
+	Backup                 string           `json:"backup,omitempty"`
+	BackupCreationPeriod   time.Duration    `json:"backupCreationPeriod,omitempty"`
+	BackupSchedule         string           `json:"backupSchedule,omitempty"`
+	BackupTimeZone         string           `json:"backupTimeZone,omitempty"`
+	BackupStartingDeadline time.Duration    `json:"backupStartingDeadline,omitempty"`
+	BackupRetentionPeriod  time.Duration    `json:"backupRetentionPeriod,omitempty"`
+	BackupRetention        *RetentionPolicy `json:"backupRetention,omitempty"`
+	BackupStorage          string           `json:"backupStorage,omitempty"`
+	BackupStorageLocation  string           `json:"backupStorageLocation,omitempty"`
+	BackupCompression      string           `json:"backupCompression,omitempty"`
+	BackupVerifyRestore    bool             `json:"backupVerifyRestore,omitempty"`
+	BackupVerifyPeriod     time.Duration    `json:"backupVerifyPeriod,omitempty"`
+	BackupSource           SnapshotSource   `json:"backupSource,omitempty"`
+	BackupEncryption       *EncryptionSpec  `json:"backupEncryption,omitempty"`
+	BackupType             BackupType       `json:"backupType,omitempty"`
+	BackupPrefixes         []string         `json:"backupPrefixes,omitempty"`
+	BackupJournal          *JournalSpec     `json:"backupJournal,omitempty"`
+	BackupReplicas         []string         `json:"backupReplicas,omitempty"`
+	// BackupDeletionPolicy defines what happens to backups on cluster
+	// deletion, default is Retain
+	// +kubebuilder:validation:Enum=Retain;Delete;RetainLatest
+	BackupDeletionPolicy BackupDeletionPolicy `json:"backupDeletionPolicy,omitempty"`
+	// FinalBackup takes backup of cluster before its teardown, final backup
+	// is kept regardless of deletion policy
+	FinalBackup bool `json:"finalBackup,omitempty"`
+	// DeletionProtection rejects cluster deletion
+	DeletionProtection bool `json:"deletionProtection,omitempty"`
+	// AutoRecovery restores cluster which lost quorum from its newest
+	// verified backup, changes made after the backup are lost. It requires
+	// backupVerifyRestore, which is applied to backup schedule of cluster
+	AutoRecovery *AutoRecoverySpec `json:"autoRecovery,omitempty"`
+	Monitoring   *MonitoringSpec   `json:"monitoring,omitempty"`
+}
+
+// AutoRecoverySpec defines automatic recovery of failed cluster
+type AutoRecoverySpec struct {
+	Enabled bool `json:"enabled,omitempty"`
+	// GracePeriod is how long cluster stays failed before it is restored,
+	// default is 15 minutes
+	GracePeriod time.Duration `json:"gracePeriod,omitempty"`
+}
+
+func (in *AutoRecoverySpec) GetGracePeriod() time.Duration {
+	if in.GracePeriod > 0 {
+		return in.GracePeriod
+	}
+
+	return DefaultRecoveryGracePeriod
+}
+
+// MonitoringSpec defines how etcd metrics are scraped
+type MonitoringSpec struct {
+	Enabled  bool              `json:"enabled,omitempty"`
+	Interval time.Duration     `json:"interval,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
 }
 
 // ClusterStatus defines the observed state of etcd cluster
 type ClusterStatus struct {
-	Phase              ClusterPhase `json:"phase,omitempty" yaml:"phase,omitempty"`
-	Version            string       `json:"version,omitempty" yaml:"version,omitempty"`
-	CertificateExpires bool         `json:"certificateExpires,omitempty" yaml:"certificateExpires,omitempty"`
+	Phase              ClusterPhase       `json:"phase,omitempty" yaml:"phase,omitempty"`
+	Version            string             `json:"version,omitempty" yaml:"version,omitempty"`
+	CertificateExpires bool               `json:"certificateExpires,omitempty" yaml:"certificateExpires,omitempty"`
+	ClusterToken       string             `json:"clusterToken,omitempty" yaml:"clusterToken,omitempty"`
+	RestoredBackup     string             `json:"restoredBackup,omitempty" yaml:"restoredBackup,omitempty"`
+	Restore            string             `json:"restore,omitempty" yaml:"restore,omitempty"`
+	Conditions         []metav1.Condition `json:"conditions,omitempty" yaml:"conditions,omitempty"`
+	// Fenced is set while members of cluster restored to point in time are
+	// created and journal is replayed onto them, cluster stays in Restoring
+	// phase and is not released until restore is finished
+	Fenced bool `json:"fenced,omitempty" yaml:"fenced,omitempty"`
+	// History identifies history of cluster revisions, it is changed
+	// whenever revisions could be reused, that is on in-place restoration
+	// and on forced new cluster
+	History string `json:"history,omitempty" yaml:"history,omitempty"`
+	// FailedTime is time cluster lost quorum, it is reset once cluster
+	// leaves Failed phase
+	FailedTime metav1.Time `json:"failedTime,omitempty" yaml:"failedTime,omitempty"`
+	// Recovery is the latest automatic recovery of cluster
+	Recovery *RecoveryStatus `json:"recovery,omitempty" yaml:"recovery,omitempty"`
+	// ForceNewCluster is the latest recovery of cluster from its surviving
+	// member
+	ForceNewCluster *ForceNewClusterStatus `json:"forceNewCluster,omitempty" yaml:"forceNewCluster,omitempty"`
+}
+
+// RecoveryStatus records automatic recovery of failed cluster from backup
+type RecoveryStatus struct {
+	Restore string `json:"restore,omitempty" yaml:"restore,omitempty"`
+	Backup  string `json:"backup,omitempty" yaml:"backup,omitempty"`
+	// BackupTime is time snapshot of restored backup was started at
+	BackupTime metav1.Time `json:"backupTime,omitempty" yaml:"backupTime,omitempty"`
+	// FailedTime is time cluster lost quorum at
+	FailedTime metav1.Time `json:"failedTime,omitempty" yaml:"failedTime,omitempty"`
+	// DataLossWindow is period between backup and failure, changes made
+	// during it are lost
+	DataLossWindow metav1.Duration `json:"dataLossWindow,omitempty" yaml:"dataLossWindow,omitempty"`
+}
+
+// ForceNewClusterStatus records recovery of cluster which lost quorum from
+// its surviving member. Member with the highest applied index is restarted as
+// new single-member cluster, other members are wiped and re-added one by one
+type ForceNewClusterStatus struct {
+	Request string               `json:"request,omitempty" yaml:"request,omitempty"`
+	Phase   ForceNewClusterPhase `json:"phase,omitempty" yaml:"phase,omitempty"`
+	Message string               `json:"message,omitempty" yaml:"message,omitempty"`
+	// Member is surviving member cluster is recovered from
+	Member       string `json:"member,omitempty" yaml:"member,omitempty"`
+	AppliedIndex uint64 `json:"appliedIndex,omitempty" yaml:"appliedIndex,omitempty"`
+	// Joining is member being re-added to recovered cluster
+	Joining string `json:"joining,omitempty" yaml:"joining,omitempty"`
+	// Readded are members wiped and re-added to recovered cluster
+	Readded        []string    `json:"readded,omitempty" yaml:"readded,omitempty"`
+	StartTime      metav1.Time `json:"startTime,omitempty" yaml:"startTime,omitempty"`
+	CompletionTime metav1.Time `json:"completionTime,omitempty" yaml:"completionTime,omitempty"`
+}
+
+// ForceNewClusterPhase defines progress of cluster recovery from surviving
+// member
+type ForceNewClusterPhase string
+
+var (
+	ForceNewClusterStarting  ForceNewClusterPhase = "Starting"
+	ForceNewClusterReadding  ForceNewClusterPhase = "Readding"
+	ForceNewClusterCompleted ForceNewClusterPhase = "Completed"
+	ForceNewClusterFailed    ForceNewClusterPhase = "Failed"
+)
+
+// IsReadded returns true if member is already wiped and re-added to
+// recovered cluster
+func (in *ForceNewClusterStatus) IsReadded(member string) bool {
+	for _, readded := range in.Readded {
+		if readded == member {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (in *ForceNewClusterStatus) SetFailed(message string) {
+	in.Phase = ForceNewClusterFailed
+	in.Message = message
+	in.CompletionTime = metav1.Now()
 }
 
 type ClusterPhase string
@@ -58,6 +225,8 @@ var (
 	ClusterUpdating     ClusterPhase = "Updating"
 	ClusterMinorFailure ClusterPhase = "MinorFailure"
 	ClusterFailed       ClusterPhase = "Failed"
+	ClusterRestoring    ClusterPhase = "Restoring"
+	ClusterRecovering   ClusterPhase = "Recovering"
 )
 
 //+kubebuilder:object:root=true
@@ -153,11 +322,145 @@ func (in *Cluster) GetService() *corev1.Service {
 			}, {
 				Name: "etcd-client-ssl",
 				Port: 2379,
+			}, {
+				Name: "metrics",
+				Port: 2381,
 			}},
 		},
 	}
 }
 
+func (in *Cluster) GetPodMonitor() *unstructured.Unstructured {
+	endpoint := map[string]interface{}{
+		"port": "metrics",
+	}
+	if in.Spec.Monitoring.Interval != 0 {
+		endpoint["interval"] = fmt.Sprintf("%ds", int64(in.Spec.Monitoring.Interval.Seconds()))
+	}
+
+	monitor := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"spec": map[string]interface{}{
+				"selector": map[string]interface{}{
+					"matchLabels": map[string]interface{}{
+						"name": in.Name,
+					},
+				},
+				"podMetricsEndpoints": []interface{}{
+					endpoint,
+				},
+			},
+		},
+	}
+	monitor.SetGroupVersionKind(PodMonitorGroupVersionKind)
+	monitor.SetName(in.Name)
+	monitor.SetNamespace(in.Namespace)
+	monitor.SetLabels(in.Spec.Monitoring.Labels)
+
+	return monitor
+}
+
+func (in *Cluster) MonitoringEnabled() bool {
+	return in.Spec.Monitoring != nil && in.Spec.Monitoring.Enabled
+}
+
+func (in Cluster) GetBackupDeletionPolicy() BackupDeletionPolicy {
+	if in.Spec.BackupDeletionPolicy == "" {
+		return BackupDeletionRetain
+	}
+
+	return in.Spec.BackupDeletionPolicy
+}
+
+// NeedsBackupFinalizer returns true if backups should be handled on cluster
+// deletion
+func (in Cluster) NeedsBackupFinalizer() bool {
+	return in.Spec.FinalBackup || in.GetBackupDeletionPolicy() != BackupDeletionRetain
+}
+
+// TakesFinalBackup returns true if backup is taken before cluster teardown
+func (in Cluster) TakesFinalBackup() bool {
+	if in.Spec.FinalBackup {
+		return true
+	}
+
+	for _, finalizer := range in.Finalizers {
+		if finalizer == FinalBackupFinalizer {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AutoRecoveryEnabled returns true if failed cluster is restored from backup
+// automatically
+func (in Cluster) AutoRecoveryEnabled() bool {
+	return in.Spec.AutoRecovery != nil && in.Spec.AutoRecovery.Enabled
+}
+
+// IsRecovering returns true if recovery of the current cluster failure is
+// already started
+func (in Cluster) IsRecovering() bool {
+	return in.Status.Recovery != nil && !in.Status.FailedTime.IsZero() &&
+		in.Status.Recovery.FailedTime.Unix() == in.Status.FailedTime.Unix()
+}
+
+// ForceNewClusterRequested returns true if recovery from surviving member is
+// requested by annotation and is not started yet
+func (in Cluster) ForceNewClusterRequested() bool {
+	request := in.Annotations[ForceNewClusterAnnotation]
+
+	return request != "" && (in.Status.ForceNewCluster == nil || request != in.Status.ForceNewCluster.Request)
+}
+
+// IsForcingNewCluster returns true if cluster is being recovered from
+// surviving member
+func (in Cluster) IsForcingNewCluster() bool {
+	if in.Status.ForceNewCluster == nil {
+		return false
+	}
+
+	phase := in.Status.ForceNewCluster.Phase
+	return phase == ForceNewClusterStarting || phase == ForceNewClusterReadding
+}
+
+// GetRecoveryRestore returns restore of failed cluster from backup, it is
+// named after failure time so every failure is recovered once
+func (in *Cluster) GetRecoveryRestore(backup string) *Restore {
+	return &Restore{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s-recovery-%d", in.Name, in.Status.FailedTime.Unix()),
+			Namespace: in.Namespace,
+			Labels: map[string]string{
+				ClusterLabel: in.Name,
+			},
+		},
+		Spec: RestoreSpec{
+			Cluster: in.Name,
+			Backup:  backup,
+		},
+	}
+}
+
+// GetFinalBackup returns full snapshot taken before cluster teardown, it never
+// expires. Final backup outlives cluster, so it is named after cluster UID
+// and recreated cluster of the same name takes its own one
+func (in *Cluster) GetFinalBackup() *Backup {
+	uid := string(in.UID)
+	if len(uid) > 8 {
+		uid = uid[:8]
+	}
+
+	backup := in.GetBackupSchedule().GetBackup()
+	backup.Name = fmt.Sprintf("%s-final-%s", in.Name, uid)
+	backup.Spec.RetentionPeriod = 0
+	backup.Spec.Type = BackupTypeSnapshot
+	backup.Spec.Prefixes = nil
+
+	return backup
+}
+
 func (in *Cluster) GetBackupSchedule() *BackupSchedule {
 	return &BackupSchedule{
 		ObjectMeta: metav1.ObjectMeta{
@@ -168,8 +471,23 @@ func (in *Cluster) GetBackupSchedule() *BackupSchedule {
 			},
 		},
 		Spec: BackupScheduleSpec{
-			CreationPeriod:  in.Spec.BackupCreationPeriod,
-			RetentionPeriod: in.Spec.BackupRetentionPeriod,
+			Schedule:         in.Spec.BackupSchedule,
+			TimeZone:         in.Spec.BackupTimeZone,
+			StartingDeadline: in.Spec.BackupStartingDeadline,
+			CreationPeriod:   in.Spec.BackupCreationPeriod,
+			RetentionPeriod:  in.Spec.BackupRetentionPeriod,
+			Retention:        in.Spec.BackupRetention.DeepCopy(),
+			VerifyRestore:    in.Spec.BackupVerifyRestore,
+			VerifyPeriod:     in.Spec.BackupVerifyPeriod,
+			Source:           in.Spec.BackupSource,
+			Storage:          in.Spec.BackupStorage,
+			StorageLocation:  in.Spec.BackupStorageLocation,
+			Compression:      in.Spec.BackupCompression,
+			Encryption:       in.Spec.BackupEncryption.DeepCopy(),
+			Type:             in.Spec.BackupType,
+			Prefixes:         in.Spec.BackupPrefixes,
+			Journal:          in.Spec.BackupJournal.DeepCopy(),
+			Replicas:         in.Spec.BackupReplicas,
 		},
 	}
 }
@@ -191,14 +509,43 @@ func (in *Cluster) GetMember(num int) *Member {
 		},
 		Spec: MemberSpec{
 			Version:      in.Spec.Version,
-			ClusterToken: string(in.GetUID()),
+			ClusterToken: in.GetClusterToken(),
 			ClusterName:  in.Name,
 			Members:      members,
-			Backup:       in.Spec.Backup,
+			Backup:       in.GetBackup(),
 		},
 	}
 }
 
+// GetClusterToken returns token of etcd cluster, which is changed after each
+// in-place restoration
+func (in *Cluster) GetClusterToken() string {
+	if in.Status.ClusterToken != "" {
+		return in.Status.ClusterToken
+	}
+
+	return string(in.GetUID())
+}
+
+// GetHistory returns history of cluster revisions, journal of cluster is
+// written separately for every history
+func (in *Cluster) GetHistory() string {
+	if in.Status.History != "" {
+		return in.Status.History
+	}
+
+	return in.GetClusterToken()
+}
+
+// GetBackup returns backup which members are restored from
+func (in *Cluster) GetBackup() string {
+	if in.Status.RestoredBackup != "" {
+		return in.Status.RestoredBackup
+	}
+
+	return in.Spec.Backup
+}
+
 func (in *Cluster) GetMemberName(num int) string {
 	return fmt.Sprintf("%s-%d", in.Name, num)
 }
@@ -222,6 +569,8 @@ type PrettyClusterSpec struct {
 	Version               string `json:"version,omitempty" yaml:"version,omitempty"`
 	Backup                string `json:"backup,omitempty" yaml:"backup,omitempty"`
 	BackupCreationPeriod  string `json:"backupCreationPeriod,omitempty" yaml:"backupCreationPeriod,omitempty"`
+	BackupSchedule        string `json:"backupSchedule,omitempty" yaml:"backupSchedule,omitempty"`
+	BackupTimeZone        string `json:"backupTimeZone,omitempty" yaml:"backupTimeZone,omitempty"`
 	BackupRetentionPeriod string `json:"backupRetentionPeriod,omitempty" yaml:"backupRetentionPeriod,omitempty"`
 }
 
@@ -241,6 +590,8 @@ func (in Cluster) Prettify() interface{} {
 			Size:                  in.Spec.Size,
 			Backup:                in.Spec.Backup,
 			BackupCreationPeriod:  duration.HumanDuration(in.Spec.BackupCreationPeriod),
+			BackupSchedule:        in.Spec.BackupSchedule,
+			BackupTimeZone:        in.Spec.BackupTimeZone,
 			BackupRetentionPeriod: duration.HumanDuration(in.Spec.BackupRetentionPeriod),
 		},
 		Status: in.Status,
@@ -34,7 +34,7 @@ func (r *Cluster) SetupWebhookWithManager(mgr ctrl.Manager) error {
 		Complete()
 }
 
-//+kubebuilder:webhook:path=/validate,mutating=false,failurePolicy=fail,sideEffects=None,groups=operator.etcd.io,resources=clusters,verbs=create;update,versions=v1alpha1,name=vcluster.kb.io,admissionReviewVersions=v1
+//+kubebuilder:webhook:path=/validate,mutating=false,failurePolicy=fail,sideEffects=None,groups=operator.etcd.io,resources=clusters,verbs=create;update;delete,versions=v1alpha1,name=vcluster.kb.io,admissionReviewVersions=v1
 
 var _ webhook.Validator = &Cluster{}
 
@@ -44,7 +44,7 @@ func (r *Cluster) ValidateCreate() error {
 		return fmt.Errorf("size of cluster should be odd, got %d", r.Spec.Size)
 	}
 
-	return nil
+	return r.validateBackup()
 }
 
 // ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
@@ -57,16 +57,81 @@ func (r *Cluster) ValidateUpdate(old runtime.Object) error {
 		return fmt.Errorf("unable to change cluster version on updating cluster")
 	}
 	if oldCluster.Spec.Backup != r.Spec.Backup {
-		return fmt.Errorf("unable to restore working cluster from backup, please create new one")
+		return fmt.Errorf("unable to restore working cluster by changing backup, please create Restore resource")
 	}
 	if oldCluster.Spec.Size != r.Spec.Size {
 		return fmt.Errorf("changing cluster size currently not supported")
 	}
 
+	return r.validateBackup()
+}
+
+// validateBackupReplicas rejects replicas copying backup into its primary
+// location or into the same location twice
+func (r *Cluster) validateBackupReplicas() error {
+	seen := make(map[string]bool)
+	for _, location := range r.Spec.BackupReplicas {
+		if location == "" {
+			return fmt.Errorf("backup replica location name should not be empty")
+		}
+		if location == r.Spec.BackupStorageLocation {
+			return fmt.Errorf("backup replica %s is the primary backup storage location", location)
+		}
+		if seen[location] {
+			return fmt.Errorf("backup replica %s is listed twice", location)
+		}
+		seen[location] = true
+	}
+
+	return nil
+}
+
+func (r *Cluster) validateBackup() error {
+	if err := r.validateBackupCompression(); err != nil {
+		return err
+	}
+	if r.Spec.BackupSchedule != "" {
+		if _, err := ParseCronSchedule(r.Spec.BackupSchedule, r.Spec.BackupTimeZone); err != nil {
+			return err
+		}
+	}
+	if r.Spec.BackupEncryption != nil && (r.Spec.BackupEncryption.KeySecret == "" || r.Spec.BackupEncryption.KeyID == "") {
+		return fmt.Errorf("both key secret and key ID are required for backup encryption")
+	}
+	if err := r.validateBackupReplicas(); err != nil {
+		return err
+	}
+	if r.Spec.BackupRetention != nil && r.Spec.BackupRetention.IsEmpty() {
+		return fmt.Errorf("backup retention policy should keep backups by at least one rule")
+	}
+	switch r.Spec.BackupType {
+	case "", BackupTypeSnapshot, BackupTypeExport:
+	default:
+		return fmt.Errorf("unknown backup type %q, should be Snapshot or Export", r.Spec.BackupType)
+	}
+	// backupVerifyRestore is synchronized into backup schedule of cluster,
+	// so backups taken after it is enabled are verified
+	if r.AutoRecoveryEnabled() && !r.Spec.BackupVerifyRestore {
+		return fmt.Errorf("automatic recovery uses verified backups only, backupVerifyRestore should be enabled")
+	}
+
 	return nil
 }
 
+func (r *Cluster) validateBackupCompression() error {
+	switch r.Spec.BackupCompression {
+	case "", "gzip", "zstd":
+		return nil
+	}
+
+	return fmt.Errorf("unknown backup compression %q, should be gzip or zstd", r.Spec.BackupCompression)
+}
+
 // ValidateDelete implements webhook.Validator so a webhook will be registered for the type
 func (r *Cluster) ValidateDelete() error {
+	if r.Spec.DeletionProtection {
+		return fmt.Errorf("cluster %s is protected from deletion, disable deletionProtection to delete it", r.Name)
+	}
+
 	return nil
 }
@@ -38,6 +38,9 @@ type MemberSpec struct {
 	Members           []string `json:"members,omitempty"`
 	Broken            bool     `json:"broken,omitempty"`
 	CertificateUpdate bool     `json:"certificateUpdate,omitempty"`
+	// ForceNewCluster restarts member as new single-member cluster keeping
+	// its data, it is used for recovery of cluster which lost quorum
+	ForceNewCluster bool `json:"forceNewCluster,omitempty"`
 }
 
 // MemberStatus defines the observed state of an etcd cluster member
@@ -46,6 +49,11 @@ type MemberStatus struct {
 	Phase              MemberPhase `json:"phase,omitempty"`
 	FailedTime         metav1.Time `json:"failedTime,omitempty"`
 	CertificateExpires bool        `json:"certificateExpires,omitempty"`
+
+	RestorePhase   MemberRestorePhase `json:"restorePhase,omitempty"`
+	RestoreMessage string             `json:"restoreMessage,omitempty"`
+
+	ForceNewCluster MemberForceNewClusterPhase `json:"forceNewCluster,omitempty"`
 }
 
 // MemberPhase defines status of specific etcd cluster member
@@ -59,6 +67,35 @@ var (
 	MemberFailed     MemberPhase = "Failed"
 )
 
+// MemberRestorePhase defines progress of member restoration from backup
+type MemberRestorePhase string
+
+var (
+	MemberRestoreDownloading MemberRestorePhase = "Downloading"
+	MemberRestoreRestoring   MemberRestorePhase = "Restoring"
+	MemberRestoreCompleted   MemberRestorePhase = "Completed"
+	MemberRestoreFailed      MemberRestorePhase = "Failed"
+)
+
+// MemberForceNewClusterPhase defines progress of member restart as new
+// single-member cluster
+type MemberForceNewClusterPhase string
+
+var (
+	// MemberForceNewClusterStarting is set while member runs with
+	// --force-new-cluster flag
+	MemberForceNewClusterStarting MemberForceNewClusterPhase = "Starting"
+	// MemberForceNewClusterCompleted is set once member is restarted without
+	// the flag, so it is never forced again
+	MemberForceNewClusterCompleted MemberForceNewClusterPhase = "Completed"
+)
+
+const (
+	FetchContainerName   = "backup-fetch"
+	RestoreContainerName = "etcd-restore"
+	VerifyContainerName  = "snapshot-status"
+)
+
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
 
@@ -144,7 +181,7 @@ func (in Member) GetPVC() *corev1.PersistentVolumeClaim {
 }
 
 func (in Member) GetPod() *corev1.Pod {
-	return &corev1.Pod{
+	pod := &corev1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      in.Name,
 			Namespace: in.Namespace,
@@ -184,23 +221,35 @@ func (in Member) GetPod() *corev1.Pod {
 			}},
 		},
 	}
+
+	if in.ShouldRestore() {
+		pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+			Name: in.GetSnapshotVolumeName(),
+			VolumeSource: corev1.VolumeSource{
+				EmptyDir: &corev1.EmptyDirVolumeSource{},
+			},
+		})
+	}
+
+	return pod
 }
 
 func (in Member) GetInitContainers() []corev1.Container {
-	if in.Spec.Backup == "" || in.Status.Phase == MemberRecreating {
+	if !in.ShouldRestore() {
 		return nil
 	}
 
 	return []corev1.Container{{
-		Name:  "etcd-restore",
-		Image: in.GetImage(),
+		Name:                     RestoreContainerName,
+		Image:                    in.GetImage(),
+		TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError,
 		Command: []string{
 			"/usr/local/bin/etcdctl",
 		},
 		Args: []string{
 			"snapshot",
 			"restore",
-			"snapshot.db",
+			in.GetSnapshotPath(),
 			"--name", in.Name,
 			"--initial-cluster", in.GetCluster(),
 			"--initial-cluster-token", in.Spec.ClusterToken,
@@ -210,12 +259,12 @@ func (in Member) GetInitContainers() []corev1.Container {
 		VolumeMounts: []corev1.VolumeMount{{
 			MountPath: in.GetDataPath(),
 			Name:      in.GetDataVolumeName(),
-		}},
+		}, in.GetSnapshotVolumeMount()},
 	}}
 }
 
 func (in Member) GetContainers() []corev1.Container {
-	return []corev1.Container{{
+	container := corev1.Container{
 		Name:           "etcd",
 		Image:          in.GetImage(),
 		ReadinessProbe: in.GetProbe(),
@@ -223,6 +272,9 @@ func (in Member) GetContainers() []corev1.Container {
 			ContainerPort: 2379,
 		}, {
 			ContainerPort: 2380,
+		}, {
+			Name:          "metrics",
+			ContainerPort: 2381,
 		}},
 		Command: []string{
 			"/usr/local/bin/etcd",
@@ -233,6 +285,7 @@ func (in Member) GetContainers() []corev1.Container {
 			"--listen-peer-urls", "https://0.0.0.0:2380",
 			"--advertise-client-urls", in.GetAdvertiseClientURL(),
 			"--listen-client-urls", "https://0.0.0.0:2379",
+			"--listen-metrics-urls", "http://0.0.0.0:2381",
 			"--initial-cluster", in.GetCluster(),
 			"--initial-cluster-state", in.GetState(),
 			"--initial-cluster-token", in.Spec.ClusterToken,
@@ -254,7 +307,12 @@ func (in Member) GetContainers() []corev1.Container {
 			MountPath: in.GetClientCertPath(),
 			Name:      in.GetClientCertVolumeName(),
 		}},
-	}}
+	}
+	if in.Status.ForceNewCluster == MemberForceNewClusterStarting {
+		container.Args = append(container.Args, "--force-new-cluster")
+	}
+
+	return []corev1.Container{container}
 }
 
 func (in Member) GetDataVolumeName() string {
@@ -265,6 +323,21 @@ func (in Member) GetDataPath() string {
 	return "/var/lib/etcd"
 }
 
+func (in Member) GetSnapshotVolumeName() string {
+	return "snapshot"
+}
+
+func (in Member) GetSnapshotVolumeMount() corev1.VolumeMount {
+	return corev1.VolumeMount{
+		MountPath: "/var/lib/snapshot",
+		Name:      in.GetSnapshotVolumeName(),
+	}
+}
+
+func (in Member) GetSnapshotPath() string {
+	return path.Join(in.GetSnapshotVolumeMount().MountPath, "snapshot.db")
+}
+
 func (in Member) GetPeerCertVolumeName() string {
 	return "peer-cert"
 }
@@ -350,6 +423,10 @@ func (in Member) IsCreating() bool {
 	return in.Status.Phase == MemberCreating || in.Status.Phase == MemberRecreating || in.Status.Phase == ""
 }
 
+func (in Member) ShouldRestore() bool {
+	return in.Spec.Backup != "" && in.Status.Phase != MemberRecreating && in.Status.RestorePhase != MemberRestoreCompleted
+}
+
 func (in Member) ShouldUpdate() bool {
 	return in.Status.Phase == MemberRunning &&
 		(in.Status.Version != in.Spec.Version ||
@@ -0,0 +1,107 @@
+/*
+Copyright 2022 Evgenii Omelchenko.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3.
+
+This program is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// RestoreSpec defines the desired state of Restore
+type RestoreSpec struct {
+	Cluster string `json:"cluster"`
+	Backup  string `json:"backup"`
+	// Prefixes limit keys imported from export backup, all exported keys are
+	// imported if they are not set. Export backups are imported into running
+	// cluster without its restoration, restore of snapshot backup with
+	// prefixes is failed
+	Prefixes []string `json:"prefixes,omitempty"`
+	// Revision enables point-in-time recovery, journal of backup cluster is
+	// replayed onto restored snapshot up to this revision. Cluster is not
+	// released until journal is replayed. Keys attached to leases are
+	// replayed without them, so they never expire
+	Revision int64 `json:"revision,omitempty"`
+	// Time enables point-in-time recovery, journal of backup cluster is
+	// replayed onto restored snapshot up to changes received at this time
+	Time *metav1.Time `json:"time,omitempty"`
+}
+
+// RestoreStatus defines the observed state of Restore
+type RestoreStatus struct {
+	Phase          RestorePhase `json:"phase,omitempty"`
+	Message        string       `json:"message,omitempty"`
+	StartTime      metav1.Time  `json:"startTime,omitempty"`
+	CompletionTime metav1.Time  `json:"completionTime,omitempty"`
+	// Revision is the latest revision replayed from journal
+	Revision int64 `json:"revision,omitempty"`
+}
+
+// RestorePhase defines progress of in-place cluster restoration
+type RestorePhase string
+
+var (
+	RestorePending         RestorePhase = "Pending"
+	RestoreStoppingMembers RestorePhase = "StoppingMembers"
+	RestoreWipingVolumes   RestorePhase = "WipingVolumes"
+	RestoreRestoring       RestorePhase = "Restoring"
+	RestoreImporting       RestorePhase = "Importing"
+	RestoreReplaying       RestorePhase = "Replaying"
+	RestoreCompleted       RestorePhase = "Completed"
+	RestoreFailed          RestorePhase = "Failed"
+)
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Cluster",type=string,JSONPath=`.spec.cluster`
+//+kubebuilder:printcolumn:name="Backup",type=string,JSONPath=`.spec.backup`
+//+kubebuilder:printcolumn:name="Status",type=string,JSONPath=`.status.phase`
+
+// Restore is the Schema for the restores API
+type Restore struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   RestoreSpec   `json:"spec,omitempty"`
+	Status RestoreStatus `json:"status,omitempty"`
+}
+
+func (in Restore) IsFinished() bool {
+	return in.Status.Phase == RestoreCompleted || in.Status.Phase == RestoreFailed
+}
+
+// IsPointInTime returns true if restore replays journal onto snapshot
+func (in Restore) IsPointInTime() bool {
+	return in.Spec.Revision > 0 || in.Spec.Time != nil
+}
+
+func (in *Restore) SetFailed(message string) {
+	in.Status.Phase = RestoreFailed
+	in.Status.Message = message
+	in.Status.CompletionTime = metav1.Now()
+}
+
+//+kubebuilder:object:root=true
+
+// RestoreList contains a list of Restore
+type RestoreList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []Restore `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&Restore{}, &RestoreList{})
+}
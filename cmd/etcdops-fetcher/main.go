@@ -0,0 +1,129 @@
+/*
+Copyright 2022 Evgenii Omelchenko.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3.
+
+This program is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Command etcdops-fetcher downloads etcd snapshot from backup storage before
+// member restoration, it is run as an init container of member pods
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/elemir/etcdops/pkg/snapshot"
+	"github.com/elemir/etcdops/pkg/storage"
+)
+
+func main() {
+	var config storage.S3Config
+	var key string
+	var compression string
+	var encryptionKey string
+	var checksum string
+	var output string
+
+	flag.StringVar(&config.Endpoint, "endpoint", "", "Override default amazon S3 URL.")
+	flag.StringVar(&config.Region, "region", "", "Region of S3 bucket.")
+	flag.StringVar(&config.Bucket, "bucket", "", "Bucket in S3 with backups.")
+	flag.StringVar(&config.Prefix, "prefix", "", "Folder in S3 with backups.")
+	flag.BoolVar(&config.ForcePathStyle, "force-path-style", false, "Use path-style addressing of S3 bucket.")
+	flag.StringVar(&key, "key", "", "Key of backup inside storage.")
+	flag.StringVar(&compression, "compression", "", "Compression codec of stored backup: gzip or zstd.")
+	flag.StringVar(&encryptionKey, "encryption-key", "", "Path to AES-256 key stored backup is encrypted with.")
+	flag.StringVar(&checksum, "checksum", "", "Expected hex encoded SHA-256 of stored backup.")
+	flag.StringVar(&output, "output", "snapshot.db", "Path to downloaded snapshot.")
+	flag.Parse()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	if err := fetch(ctx, config, key, compression, encryptionKey, checksum, output); err != nil {
+		fmt.Fprintf(os.Stderr, "unable to fetch backup %s: %v\n", key, err)
+		os.Exit(1)
+	}
+}
+
+func fetch(ctx context.Context, config storage.S3Config, key, compression, encryptionKey, checksum, output string) error {
+	backupStorage, err := storage.NewS3Storage(config)
+	if err != nil {
+		return err
+	}
+
+	info, err := backupStorage.Stat(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	body, err := backupStorage.Download(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	if err := os.MkdirAll(filepath.Dir(output), 0o750); err != nil {
+		return err
+	}
+	file, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	stored := &snapshot.CountingReader{Reader: io.TeeReader(body, hash)}
+
+	var decrypted io.Reader = stored
+	if encryptionKey != "" {
+		keyData, err := os.ReadFile(encryptionKey)
+		if err != nil {
+			return err
+		}
+
+		decrypted, err = snapshot.Decrypt(stored, keyData)
+		if err != nil {
+			return err
+		}
+	}
+
+	decompressed, err := snapshot.Decompress(decrypted, compression)
+	if err != nil {
+		return err
+	}
+	defer decompressed.Close()
+
+	if _, err := io.Copy(file, decompressed); err != nil {
+		return err
+	}
+	// decoders could stop before the end of stored object
+	if _, err := io.Copy(io.Discard, stored); err != nil {
+		return err
+	}
+	if stored.Count != info.Size {
+		return fmt.Errorf("downloaded %d bytes, but stored object has %d bytes", stored.Count, info.Size)
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); checksum != "" && sum != checksum {
+		return fmt.Errorf("downloaded object has checksum %s, expected %s", sum, checksum)
+	}
+
+	return snapshot.Verify(file)
+}
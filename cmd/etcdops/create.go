@@ -33,6 +33,26 @@ type createParams struct {
 	fromBackup            string
 	backupCreationPeriod  time.Duration
 	backupRetentionPeriod time.Duration
+	backupSchedule        string
+	backupTimeZone        string
+	backupRetention       api.RetentionPolicy
+	backupSource          string
+	backupType            string
+	backupPrefixes        []string
+	backupJournal         bool
+	backupReplicas        []string
+	backupDeletionPolicy  string
+	finalBackup           bool
+	requireFinalBackup    bool
+	deletionProtection    bool
+	autoRecovery          bool
+	autoRecoveryGrace     time.Duration
+	monitoring            bool
+	backupStorage         string
+	backupStorageLocation string
+	backupCompression     string
+	backupEncryptionKey   string
+	backupEncryptionKeyID string
 }
 
 var (
@@ -50,7 +70,30 @@ func init() {
 	createCmd.PersistentFlags().IntVar(&cp.size, "size", 3, "Number of cluster members")
 	createCmd.PersistentFlags().StringVar(&cp.fromBackup, "from-backup", "", "Backup used for a cluster restoration")
 	createCmd.PersistentFlags().DurationVar(&cp.backupCreationPeriod, "backup-creation-period", 24*time.Hour, "Creation policy of automated backups")
+	createCmd.PersistentFlags().StringVar(&cp.backupSchedule, "backup-schedule", "", "Cron schedule of automated backups, overrides creation period")
+	createCmd.PersistentFlags().StringVar(&cp.backupTimeZone, "backup-time-zone", "", "Time zone of backup schedule (default is UTC)")
+	createCmd.PersistentFlags().IntVar(&cp.backupRetention.KeepLast, "backup-keep-last", 0, "Number of the latest automated backups to keep, overrides retention period")
+	createCmd.PersistentFlags().IntVar(&cp.backupRetention.KeepDaily, "backup-keep-daily", 0, "Number of days to keep the latest automated backup of")
+	createCmd.PersistentFlags().IntVar(&cp.backupRetention.KeepWeekly, "backup-keep-weekly", 0, "Number of weeks to keep the latest automated backup of")
+	createCmd.PersistentFlags().IntVar(&cp.backupRetention.KeepMonthly, "backup-keep-monthly", 0, "Number of months to keep the latest automated backup of")
 	createCmd.PersistentFlags().DurationVar(&cp.backupRetentionPeriod, "backup-retention-period", 7*24*time.Hour, "Retention policy of automated backups")
+	createCmd.PersistentFlags().StringVar(&cp.backupStorage, "backup-storage", "", "Storage of automated backups: s3 or filesystem (default is operator's one)")
+	createCmd.PersistentFlags().StringVar(&cp.backupStorageLocation, "backup-storage-location", "", "BackupStorageLocation used for automated backups")
+	createCmd.PersistentFlags().StringVar(&cp.backupCompression, "backup-compression", "", "Compression of automated backups: gzip or zstd")
+	createCmd.PersistentFlags().StringVar(&cp.backupEncryptionKey, "backup-encryption-secret", "", "Secret with AES-256 keys used for automated backups encryption")
+	createCmd.PersistentFlags().StringVar(&cp.backupEncryptionKeyID, "backup-encryption-key-id", "", "ID of key inside backup encryption secret")
+	createCmd.PersistentFlags().StringVar(&cp.backupSource, "backup-source", "", "Member automated backups are taken from: PreferFollower, Follower, Leader or Any")
+	createCmd.PersistentFlags().StringVar(&cp.backupType, "backup-type", "", "Type of automated backups: Snapshot or Export")
+	createCmd.PersistentFlags().StringSliceVar(&cp.backupPrefixes, "backup-prefix", nil, "Key prefix included into export backups, whole keyspace is exported by default")
+	createCmd.PersistentFlags().BoolVar(&cp.backupJournal, "backup-journal", false, "Stream cluster changes into backup storage for point-in-time recovery")
+	createCmd.PersistentFlags().StringSliceVar(&cp.backupReplicas, "backup-replica", nil, "BackupStorageLocation automated backups are copied to")
+	createCmd.PersistentFlags().StringVar(&cp.backupDeletionPolicy, "backup-deletion-policy", "", "What happens to backups on cluster deletion: Retain, Delete or RetainLatest (default is Retain)")
+	createCmd.PersistentFlags().BoolVar(&cp.finalBackup, "final-backup", false, "Take backup of cluster before its deletion")
+	createCmd.PersistentFlags().BoolVar(&cp.requireFinalBackup, "require-final-backup", false, "Block cluster deletion until final backup succeeds")
+	createCmd.PersistentFlags().BoolVar(&cp.deletionProtection, "deletion-protection", false, "Reject deletion of cluster until protection is disabled")
+	createCmd.PersistentFlags().BoolVar(&cp.autoRecovery, "auto-recovery", false, "Restore cluster which lost quorum from its newest verified backup, recent changes are lost. It enables restore verification of backups")
+	createCmd.PersistentFlags().DurationVar(&cp.autoRecoveryGrace, "auto-recovery-grace-period", api.DefaultRecoveryGracePeriod, "How long cluster stays failed before automatic recovery")
+	createCmd.PersistentFlags().BoolVar(&cp.monitoring, "monitoring", false, "Create PodMonitor for scraping etcd metrics")
 
 }
 
@@ -90,8 +133,53 @@ func create(cmd *cobra.Command, args []string) error {
 			Backup:                cp.fromBackup,
 			BackupCreationPeriod:  cp.backupCreationPeriod,
 			BackupRetentionPeriod: cp.backupRetentionPeriod,
+			BackupSchedule:        cp.backupSchedule,
+			BackupTimeZone:        cp.backupTimeZone,
+			BackupSource:          api.SnapshotSource(cp.backupSource),
+			BackupType:            api.BackupType(cp.backupType),
+			BackupPrefixes:        cp.backupPrefixes,
+			BackupReplicas:        cp.backupReplicas,
+			BackupDeletionPolicy:  api.BackupDeletionPolicy(cp.backupDeletionPolicy),
+			FinalBackup:           cp.finalBackup,
+			DeletionProtection:    cp.deletionProtection,
+			BackupStorage:         cp.backupStorage,
+			BackupStorageLocation: cp.backupStorageLocation,
+			BackupCompression:     cp.backupCompression,
 		},
 	}
+	if cp.finalBackup || cp.requireFinalBackup {
+		// members should be running until final backup is taken
+		cluster.Finalizers = []string{api.CleanupSecretFinalizer}
+	}
+	if cp.requireFinalBackup {
+		cluster.Finalizers = append(cluster.Finalizers, api.FinalBackupFinalizer)
+	}
+	if cp.backupRetention != (api.RetentionPolicy{}) {
+		cluster.Spec.BackupRetention = cp.backupRetention.DeepCopy()
+	}
+	if cp.backupEncryptionKey != "" {
+		cluster.Spec.BackupEncryption = &api.EncryptionSpec{
+			KeySecret: cp.backupEncryptionKey,
+			KeyID:     cp.backupEncryptionKeyID,
+		}
+	}
+	if cp.autoRecovery {
+		cluster.Spec.BackupVerifyRestore = true
+		cluster.Spec.AutoRecovery = &api.AutoRecoverySpec{
+			Enabled:     true,
+			GracePeriod: cp.autoRecoveryGrace,
+		}
+	}
+	if cp.backupJournal {
+		cluster.Spec.BackupJournal = &api.JournalSpec{
+			Enabled: true,
+		}
+	}
+	if cp.monitoring {
+		cluster.Spec.Monitoring = &api.MonitoringSpec{
+			Enabled: true,
+		}
+	}
 
 	err = client.Create(ctx, &cluster)
 	if err != nil {
@@ -0,0 +1,98 @@
+/*
+Copyright 2022 Evgenii Omelchenko.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3.
+
+This program is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	api "github.com/elemir/etcdops/api/v1alpha1"
+	"github.com/elemir/etcdops/pkg/cli"
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var (
+	forceNewClusterConfirmed bool
+
+	forceNewClusterCmd = &cobra.Command{
+		Use:   "force-new-cluster [flags] <CLUSTER-NAME>",
+		Short: "Recover an etcd cluster which lost quorum from its surviving member",
+		Long: "Restart the surviving member with the highest applied index as a new single-member cluster " +
+			"and re-add the other members with wiped data. Changes not applied by that member are lost.",
+		Args: cobra.ExactArgs(1),
+		RunE: forceNewCluster,
+	}
+)
+
+func init() {
+	forceNewClusterCmd.PersistentFlags().BoolVar(&forceNewClusterConfirmed, "yes", false, "Confirm that data of the other members could be lost")
+}
+
+func forceNewCluster(cmd *cobra.Command, args []string) error {
+	if !forceNewClusterConfirmed {
+		return fmt.Errorf("forcing new cluster wipes data of all members but one, pass --yes to confirm")
+	}
+
+	ctx := context.Background()
+	cl, err := cli.NewClient()
+	if err != nil {
+		return err
+	}
+
+	name := args[0]
+	request := time.Now().Format(time.RFC3339Nano)
+
+	watcher, err := cl.Watch(ctx, &api.ClusterList{})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		watcher.Stop()
+	}()
+
+	cluster := api.Cluster{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: cl.Namespace,
+		},
+	}
+	patch := fmt.Sprintf(`{"metadata":{"annotations":{%q:%q}}}`, api.ForceNewClusterAnnotation, request)
+	if err := cl.Patch(ctx, &cluster, client.RawPatch(types.MergePatchType, []byte(patch))); err != nil {
+		return err
+	}
+
+	obj := watcher.Wait(func(event watch.Event) bool {
+		cluster, ok := event.Object.(*api.Cluster)
+		if !ok || cluster.Name != name || cluster.Status.ForceNewCluster == nil {
+			return false
+		}
+
+		status := cluster.Status.ForceNewCluster
+		return status.Request == request &&
+			(status.Phase == api.ForceNewClusterCompleted || status.Phase == api.ForceNewClusterFailed)
+	})
+
+	if cluster, ok := obj.(*api.Cluster); ok && cluster.Status.ForceNewCluster.Phase == api.ForceNewClusterFailed {
+		return fmt.Errorf("unable to force new cluster: %s", cluster.Status.ForceNewCluster.Message)
+	}
+
+	return nil
+}
@@ -48,6 +48,12 @@ func main() {
 	rootCmd.AddCommand(updateCmd)
 	rootCmd.AddCommand(deleteCmd)
 	rootCmd.AddCommand(listBackupsCmd)
+	rootCmd.AddCommand(restoreCmd)
+	rootCmd.AddCommand(verifyBackupCmd)
+	rootCmd.AddCommand(backupNowCmd)
+	rootCmd.AddCommand(suspendBackupsCmd)
+	rootCmd.AddCommand(resumeBackupsCmd)
+	rootCmd.AddCommand(forceNewClusterCmd)
 
 	if err := rootCmd.Execute(); err != nil {
 		os.Exit(1)
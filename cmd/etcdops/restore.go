@@ -0,0 +1,104 @@
+/*
+Copyright 2022 Evgenii Omelchenko.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3.
+
+This program is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	api "github.com/elemir/etcdops/api/v1alpha1"
+	"github.com/elemir/etcdops/pkg/cli"
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+type restoreParams struct {
+	revision int64
+	time     string
+}
+
+var (
+	rp restoreParams
+
+	restoreCmd = &cobra.Command{
+		Use:   "restore [flags] <CLUSTER-NAME> <BACKUP-NAME>",
+		Short: "Restore a working etcd cluster in place from backup",
+		Args:  cobra.ExactArgs(2),
+		RunE:  restore,
+	}
+)
+
+func init() {
+	restoreCmd.PersistentFlags().Int64Var(&rp.revision, "to-revision", 0, "Revision journal of backup cluster is replayed up to")
+	restoreCmd.PersistentFlags().StringVar(&rp.time, "to-time", "", "RFC 3339 time journal of backup cluster is replayed up to")
+}
+
+func restore(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+	client, err := cli.NewClient()
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%s-%d", args[0], time.Now().Unix())
+
+	restore := api.Restore{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: client.Namespace,
+		},
+		Spec: api.RestoreSpec{
+			Cluster:  args[0],
+			Backup:   args[1],
+			Revision: rp.revision,
+		},
+	}
+	if rp.time != "" {
+		target, err := time.Parse(time.RFC3339, rp.time)
+		if err != nil {
+			return fmt.Errorf("invalid time %q: %w", rp.time, err)
+		}
+		restore.Spec.Time = &metav1.Time{Time: target}
+	}
+
+	watcher, err := client.Watch(ctx, &api.RestoreList{})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		watcher.Stop()
+	}()
+
+	err = client.Create(ctx, &restore)
+	if err != nil {
+		return err
+	}
+
+	obj := watcher.Wait(func(event watch.Event) bool {
+		restore, ok := event.Object.(*api.Restore)
+
+		return ok && restore.IsFinished() && restore.Name == name
+	})
+
+	if restore, ok := obj.(*api.Restore); ok && restore.Status.Phase == api.RestoreFailed {
+		return fmt.Errorf("unable to restore cluster: %s", restore.Status.Message)
+	}
+
+	return nil
+}
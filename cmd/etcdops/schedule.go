@@ -0,0 +1,80 @@
+/*
+Copyright 2022 Evgenii Omelchenko.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3.
+
+This program is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	api "github.com/elemir/etcdops/api/v1alpha1"
+	"github.com/elemir/etcdops/pkg/cli"
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var (
+	backupNowCmd = &cobra.Command{
+		Use:   "backup-now <CLUSTER-NAME>",
+		Short: "Create a backup of an etcd cluster regardless of schedule",
+		Args:  cobra.ExactArgs(1),
+		RunE:  backupNow,
+	}
+
+	suspendBackupsCmd = &cobra.Command{
+		Use:   "suspend-backups <CLUSTER-NAME>",
+		Short: "Suspend scheduled backups of an etcd cluster",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return patchSchedule(args[0], `{"spec":{"suspend":true}}`)
+		},
+	}
+
+	resumeBackupsCmd = &cobra.Command{
+		Use:   "resume-backups <CLUSTER-NAME>",
+		Short: "Resume scheduled backups of an etcd cluster",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return patchSchedule(args[0], `{"spec":{"suspend":false}}`)
+		},
+	}
+)
+
+func backupNow(cmd *cobra.Command, args []string) error {
+	patch := fmt.Sprintf(`{"metadata":{"annotations":{%q:%q}}}`, api.RunNowAnnotation, time.Now().Format(time.RFC3339Nano))
+
+	return patchSchedule(args[0], patch)
+}
+
+func patchSchedule(name, patch string) error {
+	ctx := context.Background()
+	cl, err := cli.NewClient()
+	if err != nil {
+		return err
+	}
+
+	schedule := api.BackupSchedule{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: cl.Namespace,
+		},
+	}
+
+	return cl.Patch(ctx, &schedule, client.RawPatch(types.MergePatchType, []byte(patch)))
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2022 Evgenii Omelchenko.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3.
+
+This program is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	api "github.com/elemir/etcdops/api/v1alpha1"
+	"github.com/elemir/etcdops/pkg/cli"
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+var (
+	verifyBackupCmd = &cobra.Command{
+		Use:   "verify-backup <BACKUP-NAME>",
+		Short: "Verify checksum of stored backup",
+		Args:  cobra.ExactArgs(1),
+		RunE:  verifyBackup,
+	}
+)
+
+func verifyBackup(cmd *cobra.Command, args []string) error {
+	ctx := context.Background()
+	cl, err := cli.NewClient()
+	if err != nil {
+		return err
+	}
+
+	name := args[0]
+	request := time.Now().Format(time.RFC3339Nano)
+
+	watcher, err := cl.Watch(ctx, &api.BackupList{})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		watcher.Stop()
+	}()
+
+	patch := fmt.Sprintf(`{"metadata":{"annotations":{%q:%q}}}`, api.VerifyAnnotation, request)
+	backup := api.Backup{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: cl.Namespace,
+		},
+	}
+	err = cl.Patch(ctx, &backup, client.RawPatch(types.MergePatchType, []byte(patch)))
+	if err != nil {
+		return err
+	}
+
+	obj := watcher.Wait(func(event watch.Event) bool {
+		backup, ok := event.Object.(*api.Backup)
+
+		return ok && backup.Name == name && backup.Status.VerifyRequest == request
+	})
+
+	if backup, ok := obj.(*api.Backup); ok && backup.Status.VerifyError != "" {
+		return fmt.Errorf("backup is corrupted: %s", backup.Status.VerifyError)
+	}
+
+	return nil
+}
@@ -18,41 +18,57 @@ package controllers
 
 import (
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
+	"fmt"
 	"io"
-	"path"
+	"os"
 	"time"
 
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/go-logr/zapr"
 	clientv3 "go.etcd.io/etcd/client/v3"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 
 	api "github.com/elemir/etcdops/api/v1alpha1"
+	"github.com/elemir/etcdops/pkg/export"
+	"github.com/elemir/etcdops/pkg/snapshot"
+	"github.com/elemir/etcdops/pkg/storage"
 )
 
+// staleCheckPeriod is period of checking if expired backup is still the
+// newest one of its cluster
+const staleCheckPeriod = time.Hour
+
 // BackupReconciler reconciles a Backup object
 type BackupReconciler struct {
 	client.Client
-	Scheme     *runtime.Scheme
-	S3API      s3iface.S3API
-	S3Uploader *s3manager.Uploader
-	S3Bucket   string
-	S3Prefix   string
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+	Storages *storage.Registry
+	// Clientset is used for reading output of verification jobs
+	Clientset    kubernetes.Interface
+	FetcherImage string
 }
 
 //+kubebuilder:rbac:groups=operator.etcd.io,resources=backups,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=operator.etcd.io,resources=backups/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=operator.etcd.io,resources=backups/finalizers,verbs=update
+//+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;delete
+//+kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=pods/log,verbs=get
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -68,7 +84,12 @@ func (r *BackupReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctr
 	}
 
 	if backup.DeletionTimestamp != nil {
-		return ctrl.Result{}, nil
+		return r.RemoveStored(ctx, &backup)
+	}
+
+	if !controllerutil.ContainsFinalizer(&backup, api.StorageFinalizer) {
+		controllerutil.AddFinalizer(&backup, api.StorageFinalizer)
+		return ctrl.Result{}, r.Update(ctx, &backup)
 	}
 
 	defer func() {
@@ -77,38 +98,181 @@ func (r *BackupReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctr
 		}
 	}()
 
-	if backup.Status.Finished.IsZero() {
-		if result, err := r.UploadBackup(ctx, &backup); err != nil || !result.IsZero() {
+	if backup.Spec.Imported && !backup.IsFinished() {
+		return r.InspectImported(ctx, &backup)
+	}
+
+	if !backup.IsFinished() {
+		if result, err := r.Attempt(ctx, &backup); err != nil || !result.IsZero() {
 			return result, err
 		}
 	}
 
-	return r.RemoveStale(ctx, &backup)
+	if backup.IsSucceeded() && backup.VerifyRequested() {
+		if result, err := r.VerifyChecksum(ctx, &backup); err != nil || !result.IsZero() {
+			return result, err
+		}
+	}
+
+	replicateResult, err := r.Replicate(ctx, &backup)
+	if err != nil {
+		return replicateResult, err
+	}
+
+	verifyResult, err := r.VerifyRestore(ctx, &backup)
+	if err != nil {
+		return verifyResult, err
+	}
+
+	staleResult, err := r.RemoveStale(ctx, &backup)
+
+	return Earliest(replicateResult, verifyResult, staleResult), err
 }
 
-func (r *BackupReconciler) UploadBackup(ctx context.Context, backup *api.Backup) (ctrl.Result, error) {
-	snapshot, err := r.Snapshot(ctx, backup)
-	if err != nil || snapshot == nil {
+// Attempt runs single backup attempt unless it should wait for backoff or
+// backup deadline is exceeded
+func (r *BackupReconciler) Attempt(ctx context.Context, backup *api.Backup) (ctrl.Result, error) {
+	if time.Now().After(backup.GetDeadline()) {
+		message := fmt.Sprintf("Backup is not finished in time after %d attempts", backup.Status.Attempts)
+		if backup.Status.Message != "" {
+			message += ", last error: " + backup.Status.Message
+		}
+		backup.SetFailed(api.BackupReasonDeadlineExceeded, message)
+		r.Recorder.Event(backup, corev1.EventTypeWarning, ReasonBackupFailed, message)
+		return ctrl.Result{}, nil
+	}
+
+	if backup.Status.Attempts > 0 {
+		nextAttempt := backup.Status.LastAttempt.Add(backup.GetBackoff())
+		if nextAttempt.After(time.Now()) {
+			return ctrl.Result{
+				RequeueAfter: nextAttempt.Sub(time.Now()),
+			}, nil
+		}
+	}
+
+	backup.Status.Phase = api.BackupRunning
+	backup.Status.Attempts++
+	backup.Status.LastAttempt = metav1.Now()
+	if err := r.Status().Update(ctx, backup); err != nil {
 		return ctrl.Result{}, err
 	}
-	defer snapshot.Close()
 
-	key := path.Join(r.S3Prefix, backup.Labels[api.ClusterLabel], backup.Name)
-	output, err := r.S3Uploader.UploadWithContext(ctx, &s3manager.UploadInput{
-		Bucket: &r.S3Bucket,
-		Key:    &key,
-		Body:   snapshot,
+	reason, err := r.UploadBackup(ctx, backup)
+	if err == nil {
+		return ctrl.Result{}, nil
+	}
+
+	log.FromContext(ctx).Error(err, "backup attempt failed", "attempt", backup.Status.Attempts)
+	r.Recorder.Eventf(backup, corev1.EventTypeWarning, ReasonBackupFailed, "Backup attempt %d failed: %v", backup.Status.Attempts, err)
+
+	if backup.Status.Attempts >= backup.GetMaxAttempts() {
+		backup.SetFailed(api.BackupReasonAttemptsExhausted, fmt.Sprintf("%s: %v", reason, err))
+		return ctrl.Result{}, nil
+	}
+
+	backup.Status.Phase = api.BackupPending
+	backup.Status.Reason = reason
+	backup.Status.Message = err.Error()
+
+	return ctrl.Result{
+		RequeueAfter: backup.GetBackoff(),
+	}, nil
+}
+
+// UploadBackup takes snapshot and uploads it to backup storage, it returns
+// reason of failure with error
+func (r *BackupReconciler) UploadBackup(ctx context.Context, backup *api.Backup) (string, error) {
+	backupStorage, err := GetBackupStorage(ctx, r.Client, r.Storages, backup)
+	if err != nil {
+		return api.BackupReasonStorageFailed, fmt.Errorf("unable to get backup storage: %w", err)
+	}
+
+	reader, info, err := r.Snapshot(ctx, backup)
+	if err != nil {
+		return api.BackupReasonSnapshotFailed, fmt.Errorf("unable to take snapshot: %w", err)
+	}
+	if reader == nil {
+		return api.BackupReasonClusterNotFound, fmt.Errorf("cluster %s not found", backup.Labels[api.ClusterLabel])
+	}
+	defer reader.Close()
+
+	// snapshot is kept locally to compute its status after upload, bbolt
+	// could not read it from stream
+	local, err := os.CreateTemp("", "snapshot-*.db")
+	if err != nil {
+		return api.BackupReasonSnapshotFailed, fmt.Errorf("unable to create snapshot file: %w", err)
+	}
+	defer os.Remove(local.Name())
+	defer local.Close()
+
+	raw := &snapshot.CountingReader{Reader: io.TeeReader(reader, local)}
+	compressed, err := snapshot.Compress(raw, backup.Spec.Compression)
+	if err != nil {
+		return api.BackupReasonEncodingFailed, fmt.Errorf("unable to compress snapshot: %w", err)
+	}
+	defer compressed.Close()
+
+	var encrypted io.Reader = compressed
+	if backup.Spec.Encryption != nil {
+		key, err := GetEncryptionKey(ctx, r.Client, backup.Namespace, backup.Spec.Encryption, backup.Spec.Encryption.KeyID)
+		if err != nil {
+			return api.BackupReasonEncodingFailed, fmt.Errorf("unable to get encryption key: %w", err)
+		}
+
+		encryptedReader, err := snapshot.Encrypt(compressed, key)
+		if err != nil {
+			return api.BackupReasonEncodingFailed, fmt.Errorf("unable to encrypt snapshot: %w", err)
+		}
+		defer encryptedReader.Close()
+		encrypted = encryptedReader
+	}
+
+	hash := sha256.New()
+	stored := &snapshot.CountingReader{Reader: io.TeeReader(encrypted, hash)}
+	retainUntil := backupStorage.LockUntil(backup.CreationTimestamp.Time, backup.Spec.RetentionPeriod)
+	url, err := backupStorage.Upload(ctx, backup.GetStorageKey(), stored, storage.UploadOptions{
+		RetainUntil: retainUntil,
 	})
 	if err != nil {
-		return ctrl.Result{}, err
+		return api.BackupReasonUploadFailed, fmt.Errorf("unable to upload snapshot: %w", err)
+	}
+	status, err := snapshot.GetStatus(local.Name())
+	if err != nil {
+		return api.BackupReasonSnapshotFailed, fmt.Errorf("unable to read snapshot status: %w", err)
+	}
+	backup.Lock(retainUntil)
+	backup.Status.URL = url
+	backup.Status.Compression = backup.Spec.Compression
+	backup.Status.Size = stored.Count
+	backup.Status.RawSize = raw.Count
+	backup.Status.Checksum = hex.EncodeToString(hash.Sum(nil))
+	backup.Status.Revision = info.Revision
+	backup.Status.EtcdVersion = info.Version
+	backup.Status.Member = info.Member
+	backup.Status.History = info.History
+	backup.Status.SnapshotHash = status.Hash
+	backup.Status.SnapshotRevision = status.Revision
+	if backup.Spec.Encryption != nil {
+		backup.Status.EncryptionKeyID = backup.Spec.Encryption.KeyID
 	}
-	backup.Status.URL = output.Location
-	backup.Status.Finished = metav1.Now()
+	backup.SetSucceeded()
+	r.Recorder.Eventf(backup, corev1.EventTypeNormal, ReasonBackupSucceeded, "Uploaded snapshot to %s", url)
 
-	return ctrl.Result{}, nil
+	return "", nil
+}
+
+// SnapshotInfo describes etcd member snapshot is taken from
+type SnapshotInfo struct {
+	Member   string
+	Revision int64
+	Version  string
+	History  string
 }
 
-func (r *BackupReconciler) Snapshot(ctx context.Context, backup *api.Backup) (io.ReadCloser, error) {
+// Snapshot streams snapshot from member of cluster selected by backup
+// snapshot source preference
+func (r *BackupReconciler) Snapshot(ctx context.Context, backup *api.Backup) (io.ReadCloser, *SnapshotInfo, error) {
 	l := log.FromContext(ctx)
 
 	var cluster api.Cluster
@@ -116,54 +280,228 @@ func (r *BackupReconciler) Snapshot(ctx context.Context, backup *api.Backup) (io
 		Name:      backup.Labels[api.ClusterLabel],
 		Namespace: backup.Namespace,
 	}, &cluster); err != nil {
-		return nil, client.IgnoreNotFound(err)
+		return nil, nil, client.IgnoreNotFound(err)
 	}
 
-	etcdConfig := clientv3.Config{
-		Endpoints:   cluster.GetEndpoints(),
-		DialTimeout: 5 * time.Second,
-		TLS: &tls.Config{
-			InsecureSkipVerify: true,
-		},
+	var candidates []snapshotCandidate
+	defer func() {
+		for _, candidate := range candidates {
+			if candidate.etcd != nil {
+				candidate.etcd.Close()
+			}
+		}
+	}()
+
+	for num := 0; num < cluster.Spec.Size; num++ {
+		member := cluster.GetMemberName(num)
+		endpoint := api.AdvertiseClientURL(member, cluster.Namespace, cluster.Name)
+
+		etcdConfig := clientv3.Config{
+			Endpoints:   []string{endpoint},
+			DialTimeout: 5 * time.Second,
+			TLS: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+		}
+
+		if zapLogger, ok := l.GetSink().(zapr.Underlier); ok {
+			etcdConfig.Logger = zapLogger.GetUnderlying()
+		}
+
+		etcd, err := clientv3.New(etcdConfig)
+		if err != nil {
+			l.Error(err, "failed to instanate etcd client")
+			return nil, nil, err
+		}
+
+		status, err := etcd.Status(ctx, endpoint)
+		if err != nil || len(status.Errors) > 0 {
+			l.Info("skip unhealthy member for snapshot", "member", member)
+			etcd.Close()
+			continue
+		}
+
+		candidates = append(candidates, snapshotCandidate{
+			member: member,
+			etcd:   etcd,
+			status: status,
+		})
 	}
 
-	if zapLogger, ok := l.GetSink().(zapr.Underlier); ok {
-		etcdConfig.Logger = zapLogger.GetUnderlying()
+	source, err := SelectSnapshotSource(backup.Spec.Source, candidates)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to select member of cluster %s: %w", cluster.Name, err)
 	}
+	l.Info("taking snapshot", "member", source.member, "type", backup.GetType())
 
-	etcd, err := clientv3.New(etcdConfig)
+	var reader io.ReadCloser
+	if backup.GetType() == api.BackupTypeExport {
+		reader = export.Export(ctx, source.etcd, source.status.Header.Revision, backup.Spec.Prefixes)
+	} else {
+		reader, err = source.etcd.Snapshot(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	etcd := source.etcd
+	// source client is closed by snapshot reader
+	source.etcd = nil
+
+	return &snapshotReader{
+		ReadCloser: reader,
+		etcd:       etcd,
+	}, &SnapshotInfo{
+		Member:   source.member,
+		Revision: source.status.Header.Revision,
+		Version:  source.status.Version,
+		History:  cluster.GetHistory(),
+	}, nil
+}
+
+// snapshotReader closes etcd client after snapshot is read
+type snapshotReader struct {
+	io.ReadCloser
+	etcd *clientv3.Client
+}
+
+func (r *snapshotReader) Close() error {
+	err := r.ReadCloser.Close()
+	if closeErr := r.etcd.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// VerifyChecksum downloads stored backup and compares its checksum with
+// the one computed on upload
+func (r *BackupReconciler) VerifyChecksum(ctx context.Context, backup *api.Backup) (ctrl.Result, error) {
+	backupStorage, err := GetBackupStorage(ctx, r.Client, r.Storages, backup)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	body, err := backupStorage.Download(ctx, backup.GetStorageKey())
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	defer body.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, body)
 	if err != nil {
-		l.Error(err, "failed to instanate etcd client")
-		return nil, err
+		return ctrl.Result{}, err
 	}
 
-	return etcd.Snapshot(ctx)
+	backup.Status.VerifyRequest = backup.Annotations[api.VerifyAnnotation]
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	switch {
+	case backup.Status.Checksum == "":
+		backup.Status.VerifyError = "backup has no recorded checksum"
+	case size != backup.Status.Size:
+		backup.Status.VerifyError = fmt.Sprintf("stored object has %d bytes, expected %d", size, backup.Status.Size)
+	case checksum != backup.Status.Checksum:
+		backup.Status.VerifyError = fmt.Sprintf("stored object has checksum %s, expected %s", checksum, backup.Status.Checksum)
+	default:
+		backup.Status.VerifyError = ""
+		backup.Status.Verified = metav1.Now()
+		r.Recorder.Event(backup, corev1.EventTypeNormal, ReasonBackupVerified, "Verified checksum of stored backup")
+
+		return ctrl.Result{}, nil
+	}
+
+	r.Recorder.Event(backup, corev1.EventTypeWarning, ReasonBackupCorrupted, backup.Status.VerifyError)
+
+	return ctrl.Result{}, nil
 }
 
+// RemoveStale removes backup after its retention period, but keeps the
+// newest succeeded backup of cluster even if it is expired
 func (r *BackupReconciler) RemoveStale(ctx context.Context, backup *api.Backup) (ctrl.Result, error) {
+	if backup.Spec.RetentionPeriod == 0 {
+		return ctrl.Result{}, nil
+	}
+
 	retentionTime := backup.CreationTimestamp.Add(backup.Spec.RetentionPeriod)
-	if retentionTime.Before(time.Now()) {
-		key := path.Join(r.S3Prefix, backup.Labels[api.ClusterLabel], backup.Name)
-		if _, err := r.S3API.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
-			Bucket: &r.S3Bucket,
-			Key:    &key,
-		}); err != nil {
+	if retentionTime.After(time.Now()) {
+		return ctrl.Result{
+			RequeueAfter: retentionTime.Sub(time.Now()),
+		}, nil
+	}
+
+	// object lock could outlive retention period if upload is retried
+	if backup.IsLocked() {
+		return ctrl.Result{
+			RequeueAfter: time.Until(backup.Status.RetainUntil.Time),
+		}, nil
+	}
+
+	newest, err := IsNewestSucceeded(ctx, r.Client, backup)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if newest {
+		return ctrl.Result{
+			RequeueAfter: staleCheckPeriod,
+		}, nil
+	}
+
+	if err := DeleteBackup(ctx, r.Client, r.Storages, backup); err != nil {
+		return ctrl.Result{}, err
+	}
+	r.Recorder.Event(backup, corev1.EventTypeNormal, ReasonBackupRemoved, "Removed backup after retention period")
+
+	return ctrl.Result{}, nil
+}
+
+// RemoveStored removes snapshot from storage before backup deletion unless
+// it should be retained
+func (r *BackupReconciler) RemoveStored(ctx context.Context, backup *api.Backup) (ctrl.Result, error) {
+	if !controllerutil.ContainsFinalizer(backup, api.StorageFinalizer) {
+		return ctrl.Result{}, nil
+	}
+
+	if !backup.Spec.RetainOnDelete && backup.IsLocked() {
+		log.FromContext(ctx).Info("postponing removal of locked backup", "retainUntil", backup.Status.RetainUntil)
+		return ctrl.Result{
+			RequeueAfter: time.Until(backup.Status.RetainUntil.Time),
+		}, nil
+	}
+
+	if backup.Spec.RetainOnDelete {
+		if err := MarkRetained(ctx, r.Client, r.Storages, backup); err != nil {
+			r.Recorder.Eventf(backup, corev1.EventTypeWarning, ReasonBackupRemoved, "Unable to mark retained snapshot: %v", err)
+			return ctrl.Result{}, err
+		}
+	} else {
+		backupStorage, err := GetBackupStorage(ctx, r.Client, r.Storages, backup)
+		switch {
+		case errors.IsNotFound(err):
+			r.Recorder.Eventf(backup, corev1.EventTypeWarning, ReasonBackupRemoved, "Storage location of backup is removed, snapshot is kept: %v", err)
+		case err != nil:
 			return ctrl.Result{}, err
+		default:
+			if err := backupStorage.Delete(ctx, backup.GetStorageKey()); err != nil {
+				r.Recorder.Eventf(backup, corev1.EventTypeWarning, ReasonBackupRemoved, "Unable to remove stored snapshot: %v", err)
+				return ctrl.Result{}, err
+			}
 		}
 
-		if err := r.Delete(ctx, backup); err != nil {
-			return ctrl.Result{}, client.IgnoreNotFound(err)
+		if err := DeleteReplicas(ctx, r.Client, backup); err != nil {
+			r.Recorder.Eventf(backup, corev1.EventTypeWarning, ReasonBackupRemoved, "Unable to remove copies of snapshot: %v", err)
+			return ctrl.Result{}, err
 		}
 	}
 
-	return ctrl.Result{
-		RequeueAfter: retentionTime.Sub(time.Now()),
-	}, nil
+	controllerutil.RemoveFinalizer(backup, api.StorageFinalizer)
+	return ctrl.Result{}, r.Update(ctx, backup)
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *BackupReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&api.Backup{}).
+		Owns(&batchv1.Job{}).
 		Complete(r)
 }
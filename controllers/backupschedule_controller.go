@@ -20,20 +20,33 @@ import (
 	"context"
 	"time"
 
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	api "github.com/elemir/etcdops/api/v1alpha1"
+	"github.com/elemir/etcdops/pkg/storage"
 )
 
+// maxMissedRuns limits number of missed runs scheduler iterates through to
+// find the latest one
+const maxMissedRuns = 1000
+
 // BackupScheduleReconciler reconciles a BackupSchedule object
 type BackupScheduleReconciler struct {
 	client.Client
-	Scheme *runtime.Scheme
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+	Storages *storage.Registry
+	Journals *JournalManager
 }
 
 //+kubebuilder:rbac:groups=operator.etcd.io,resources=backupschedules,verbs=get;list;watch;create;update;patch;delete
@@ -49,14 +62,30 @@ func (r *BackupScheduleReconciler) Reconcile(ctx context.Context, req ctrl.Reque
 	if err := r.Get(ctx, req.NamespacedName, &schedule); err != nil {
 		if !errors.IsNotFound(err) {
 			l.Error(err, "unable to fetch schedule")
+		} else {
+			r.Journals.Stop(req.NamespacedName)
 		}
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
 
 	if schedule.DeletionTimestamp != nil {
+		r.Journals.Stop(req.NamespacedName)
 		return ctrl.Result{}, nil
 	}
 
+	defer func() {
+		if err := r.Status().Update(ctx, &schedule); err != nil && !errors.IsConflict(err) {
+			l.Error(err, "unable to update schedule")
+		}
+	}()
+
+	journal, err := r.Journals.Ensure(&schedule)
+	if err != nil {
+		l.Error(err, "unable to start journal")
+		return ctrl.Result{}, err
+	}
+	schedule.Status.Journal = journal
+
 	if result, err := r.Schedule(ctx, &schedule); err != nil || !result.IsZero() {
 		return result, err
 	}
@@ -75,34 +104,128 @@ func (r *BackupScheduleReconciler) Schedule(ctx context.Context, schedule *api.B
 		return ctrl.Result{}, err
 	}
 
-	var latestBackupTime time.Time
+	if schedule.Spec.Retention != nil {
+		if err := r.ApplyRetention(ctx, schedule, backups.Items); err != nil {
+			l.Error(err, "unable to apply retention policy")
+			return ctrl.Result{}, err
+		}
+	}
+
+	var latestFailureTime time.Time
+	latestCreationTime := schedule.CreationTimestamp.Time
 
 	inProgress := false
 	for _, backup := range backups.Items {
-		if backup.Status.Finished.IsZero() {
+		// failed backups are finished too, so they don't block schedule
+		if !backup.IsFinished() {
 			inProgress = true
 		}
 
-		if backup.Status.Finished.After(latestBackupTime) {
-			latestBackupTime = backup.Status.Finished.Time
+		if backup.Status.Phase == api.BackupFailed && backup.Status.Finished.After(latestFailureTime) {
+			latestFailureTime = backup.Status.Finished.Time
+		}
+		if backup.CreationTimestamp.After(latestCreationTime) {
+			latestCreationTime = backup.CreationTimestamp.Time
+		}
+	}
+
+	schedule.UpdateStatus(backups.Items)
+
+	if schedule.RunNowRequested() {
+		if inProgress {
+			return Requeue(), nil
+		}
+
+		l.Info("starting requested run")
+		if err := r.CreateBackup(ctx, schedule); err != nil {
+			return ctrl.Result{}, err
 		}
+		// failed request is retried, so it is recorded only after creation
+		schedule.Status.RunNowRequest = schedule.Annotations[api.RunNowAnnotation]
+		return Requeue(), nil
 	}
 
-	if inProgress {
-		return Requeue(), err
+	if schedule.Spec.Suspend {
+		schedule.Status.NextScheduleTime = metav1.Time{}
+		return ctrl.Result{}, nil
 	}
 
-	nextRunTime := latestBackupTime.Add(schedule.Spec.CreationPeriod)
-	if nextRunTime.Before(time.Now()) {
+	now := time.Now()
+	nextRunTime := schedule.Status.LastSuccessfulTime.Add(schedule.Spec.CreationPeriod)
+	// failed backup is retried after backoff, not the whole period later
+	if latestFailureTime.After(schedule.Status.LastSuccessfulTime.Time) {
+		if retryTime := latestFailureTime.Add(schedule.GetFailureBackoff()); retryTime.After(nextRunTime) {
+			nextRunTime = retryTime
+		}
+	}
+	due := !nextRunTime.After(now)
+	if schedule.Spec.Schedule != "" {
+		due, nextRunTime, err = r.NextCronRun(schedule, latestCreationTime, now)
+		if err != nil {
+			l.Error(err, "unable to parse schedule")
+			return ctrl.Result{}, nil
+		}
+	}
+
+	if due {
+		if inProgress {
+			return Requeue(), nil
+		}
+
+		l.Info("starting scheduled run")
 		return Requeue(), r.CreateBackup(ctx, schedule)
 	}
 
+	schedule.Status.NextScheduleTime = metav1.NewTime(nextRunTime)
 	l.Info("scheduled next run", "nextRun", nextRunTime)
 	return ctrl.Result{
-		RequeueAfter: nextRunTime.Sub(time.Now()),
+		RequeueAfter: nextRunTime.Sub(now),
 	}, nil
 }
 
+// ApplyRetention removes backups of cluster which are not kept by schedule
+// retention policy
+func (r *BackupScheduleReconciler) ApplyRetention(ctx context.Context, schedule *api.BackupSchedule, backups []api.Backup) error {
+	location, err := time.LoadLocation(schedule.Spec.TimeZone)
+	if err != nil {
+		location = time.UTC
+	}
+
+	for _, backup := range SelectExpiredBackups(schedule.Spec.Retention, location, backups) {
+		backup := backup
+		if err := DeleteBackup(ctx, r.Client, r.Storages, &backup); err != nil {
+			return err
+		}
+		r.Recorder.Eventf(&backup, corev1.EventTypeNormal, ReasonBackupRemoved, "Removed backup by retention policy of schedule %s", schedule.Name)
+	}
+
+	return nil
+}
+
+// NextCronRun returns true if scheduled run is missed since the latest
+// backup creation and starting deadline is not exceeded, it also returns
+// time of the next scheduled run
+func (r *BackupScheduleReconciler) NextCronRun(schedule *api.BackupSchedule, latestCreationTime, now time.Time) (bool, time.Time, error) {
+	cronSchedule, err := schedule.GetCronSchedule()
+	if err != nil {
+		return false, time.Time{}, err
+	}
+
+	earliestRunTime := latestCreationTime
+	if deadline := schedule.Spec.StartingDeadline; deadline > 0 && earliestRunTime.Before(now.Add(-deadline)) {
+		earliestRunTime = now.Add(-deadline)
+	}
+
+	missed := false
+	nextRunTime := cronSchedule.Next(earliestRunTime)
+	for iteration := 0; !nextRunTime.After(now) && iteration < maxMissedRuns; iteration++ {
+		missed = true
+		nextRunTime = cronSchedule.Next(nextRunTime)
+	}
+
+	return missed, nextRunTime, nil
+}
+
 func (r *BackupScheduleReconciler) CreateBackup(ctx context.Context, schedule *api.BackupSchedule) error {
 	l := log.FromContext(ctx)
 
@@ -110,8 +233,11 @@ func (r *BackupScheduleReconciler) CreateBackup(ctx context.Context, schedule *a
 
 	if err := r.Create(ctx, backup); err != nil {
 		l.Info("unable to create backup", "name", backup.Name)
+		r.Recorder.Eventf(schedule, corev1.EventTypeWarning, ReasonBackupFailed, "Unable to create backup %s: %v", backup.Name, err)
 		return err
 	}
+	r.Recorder.Eventf(backup, corev1.EventTypeNormal, ReasonBackupCreated, "Backup created by schedule %s", schedule.Name)
+	schedule.Status.LastScheduleTime = metav1.Now()
 
 	return nil
 }
@@ -121,5 +247,6 @@ func (r *BackupScheduleReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&api.BackupSchedule{}).
 		Owns(&api.Backup{}).
+		Watches(&source.Channel{Source: r.Journals.Updates}, &handler.EnqueueRequestForObject{}).
 		Complete(r)
 }
@@ -0,0 +1,170 @@
+/*
+Copyright 2022 Evgenii Omelchenko.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3.
+
+This program is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	api "github.com/elemir/etcdops/api/v1alpha1"
+	"github.com/elemir/etcdops/pkg/storage"
+)
+
+const locationValidationPeriod = 5 * time.Minute
+
+// BackupStorageLocationReconciler reconciles a BackupStorageLocation object
+type BackupStorageLocationReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Storages *storage.Registry
+}
+
+//+kubebuilder:rbac:groups=operator.etcd.io,resources=backupstoragelocations,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=operator.etcd.io,resources=backupstoragelocations/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=operator.etcd.io,resources=backupstoragelocations/finalizers,verbs=update
+
+// Reconcile is part of the main kubernetes reconciliation loop which aims to
+// move the current state of the cluster closer to the desired state.
+func (r *BackupStorageLocationReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+
+	var location api.BackupStorageLocation
+	if err := r.Get(ctx, req.NamespacedName, &location); err != nil {
+		if !apierrors.IsNotFound(err) {
+			l.Error(err, "unable to fetch backup storage location")
+		}
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	if location.DeletionTimestamp != nil {
+		return ctrl.Result{}, nil
+	}
+
+	defer func() {
+		if err := r.Status().Update(ctx, &location); err != nil && !apierrors.IsConflict(err) {
+			l.Error(err, "unable to update backup storage location")
+		}
+	}()
+
+	if result, err := r.Validate(ctx, &location); err != nil || !result.IsZero() {
+		return result, err
+	}
+
+	return r.ScanOrphans(ctx, &location)
+}
+
+func (r *BackupStorageLocationReconciler) Validate(ctx context.Context, location *api.BackupStorageLocation) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+
+	condition := metav1.Condition{
+		Type:               api.LocationAvailable,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: location.Generation,
+		Reason:             "Validated",
+		Message:            "Bucket is accessible",
+	}
+
+	locationStorage, err := GetLocationStorage(ctx, r.Client, location)
+	if err != nil {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "InvalidConfiguration"
+		condition.Message = err.Error()
+	} else if err := locationStorage.Check(ctx); err != nil {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "AccessFailed"
+		condition.Message = err.Error()
+	}
+
+	meta.SetStatusCondition(&location.Status.Conditions, condition)
+	if condition.Status == metav1.ConditionFalse {
+		l.Info("backup storage location is unavailable", "location", location.Name, "reason", condition.Message)
+		return ctrl.Result{
+			RequeueAfter: locationValidationPeriod,
+		}, nil
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// ScanOrphans looks for stored snapshots without matching backups once per
+// orphan scan period
+func (r *BackupStorageLocationReconciler) ScanOrphans(ctx context.Context, location *api.BackupStorageLocation) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+
+	if time.Since(location.Status.LastOrphanScan.Time) < orphanScanPeriod {
+		return ctrl.Result{
+			RequeueAfter: locationValidationPeriod,
+		}, nil
+	}
+
+	locationStorage, err := GetLocationStorage(ctx, r.Client, location)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// locations could share bucket, so snapshots of all of them are known
+	stored, err := SharedBackups(ctx, r.Client, r.Storages, getLocationConfig(location))
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if location.Spec.ImportBackups {
+		if err := ImportBackups(ctx, r.Client, locationStorage, stored, location.Namespace, api.BackupSpec{
+			StorageLocation: location.Name,
+		}); err != nil {
+			l.Error(err, "unable to import backups")
+			return ctrl.Result{}, err
+		}
+		location.Status.OrphanedObjects = nil
+		location.Status.LastOrphanScan = metav1.Now()
+
+		return ctrl.Result{
+			RequeueAfter: locationValidationPeriod,
+		}, nil
+	}
+
+	orphans, err := CollectOrphans(ctx, locationStorage, stored, location.Spec.DeleteOrphans)
+	if err != nil {
+		l.Error(err, "unable to collect orphaned snapshots")
+		return ctrl.Result{}, err
+	}
+
+	if location.Spec.DeleteOrphans {
+		orphans = nil
+	}
+	location.Status.OrphanedObjects = orphans
+	location.Status.LastOrphanScan = metav1.Now()
+
+	return ctrl.Result{
+		RequeueAfter: locationValidationPeriod,
+	}, nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *BackupStorageLocationReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&api.BackupStorageLocation{}).
+		Complete(r)
+}
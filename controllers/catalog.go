@@ -0,0 +1,175 @@
+/*
+Copyright 2022 Evgenii Omelchenko.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3.
+
+This program is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"path"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	api "github.com/elemir/etcdops/api/v1alpha1"
+	"github.com/elemir/etcdops/pkg/export"
+	"github.com/elemir/etcdops/pkg/snapshot"
+	"github.com/elemir/etcdops/pkg/storage"
+)
+
+// ImportBackups creates read-only backups of stored snapshots without
+// matching backups. Imported snapshots are retained on backup deletion
+// unless it is changed in backup specification
+func ImportBackups(ctx context.Context, c client.Client, backupStorage storage.BackupStorage, backups []api.Backup, namespace string, spec api.BackupSpec) error {
+	l := log.FromContext(ctx)
+
+	orphans, err := FindOrphans(ctx, backupStorage, backups)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range orphans {
+		err := ImportBackup(ctx, c, backupStorage, namespace, key, spec)
+		if apierrors.IsAlreadyExists(err) || apierrors.IsInvalid(err) {
+			l.Info("unable to import backup snapshot", "key", key, "reason", err.Error())
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		l.Info("imported backup snapshot", "key", key)
+	}
+
+	return nil
+}
+
+// ImportBackup creates backup of snapshot stored under key, status of
+// created backup is set by backup reconciler
+func ImportBackup(ctx context.Context, c client.Client, backupStorage storage.BackupStorage, namespace, key string, spec api.BackupSpec) error {
+	_, _, backupType, err := DetectStoredFormat(ctx, backupStorage, key)
+	if err != nil {
+		return err
+	}
+
+	cluster, name := path.Split(key)
+	spec.Imported = true
+	spec.RetainOnDelete = true
+	spec.RetentionPeriod = 0
+	spec.Type = backupType
+
+	backup := &api.Backup{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels: map[string]string{
+				api.ClusterLabel: path.Clean(cluster),
+			},
+			Finalizers: []string{
+				api.StorageFinalizer,
+			},
+		},
+		Spec: spec,
+	}
+
+	return c.Create(ctx, backup)
+}
+
+// InspectImported sets status of imported backup from its stored object.
+// Checksum of imported backup is unknown, since only the first bytes of
+// object are downloaded
+func (r *BackupReconciler) InspectImported(ctx context.Context, backup *api.Backup) (ctrl.Result, error) {
+	backupStorage, err := GetBackupStorage(ctx, r.Client, r.Storages, backup)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	key := backup.GetStorageKey()
+	info, err := backupStorage.Stat(ctx, key)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	compression, encrypted, _, err := DetectStoredFormat(ctx, backupStorage, key)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	backup.Status = api.BackupStatus{
+		Phase:       api.BackupSucceeded,
+		Message:     "Imported from backup storage",
+		Finished:    metav1.NewTime(info.LastModified),
+		URL:         backupStorage.URL(key),
+		Compression: compression,
+		Size:        info.Size,
+	}
+	if encrypted {
+		backup.Status.Message = "Imported encrypted snapshot, specify its encryption, compression and type to restore it"
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// DetectStoredFormat returns compression of stored backup, whether it is
+// encrypted and its type. Only the first bytes of object are downloaded,
+// compression and type of encrypted backup are unknown
+func DetectStoredFormat(ctx context.Context, backupStorage storage.BackupStorage, key string) (string, bool, api.BackupType, error) {
+	body, err := backupStorage.Download(ctx, key)
+	if err != nil {
+		return "", false, "", err
+	}
+	defer body.Close()
+
+	header, err := readPrefix(body, 8)
+	if err != nil {
+		return "", false, "", err
+	}
+
+	compression, encrypted := snapshot.DetectFormat(header)
+	if encrypted {
+		return compression, true, api.BackupTypeSnapshot, nil
+	}
+
+	decompressed, err := snapshot.Decompress(io.MultiReader(bytes.NewReader(header), body), compression)
+	if err != nil {
+		return "", false, "", err
+	}
+	defer decompressed.Close()
+
+	prefix, err := readPrefix(decompressed, 64)
+	if err != nil {
+		return "", false, "", err
+	}
+	if export.IsExport(prefix) {
+		return compression, false, api.BackupTypeExport, nil
+	}
+
+	return compression, false, api.BackupTypeSnapshot, nil
+}
+
+// readPrefix reads up to size first bytes of r
+func readPrefix(r io.Reader, size int) ([]byte, error) {
+	prefix := make([]byte, size)
+	n, err := io.ReadFull(r, prefix)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	return prefix[:n], nil
+}
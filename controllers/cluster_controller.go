@@ -18,21 +18,31 @@ package controllers
 
 import (
 	"context"
+	"fmt"
 	"time"
 
 	certv1 "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
 	"go.uber.org/multierr"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 
 	api "github.com/elemir/etcdops/api/v1alpha1"
+	"github.com/elemir/etcdops/pkg/storage"
 )
 
 const (
@@ -43,16 +53,22 @@ const (
 type ClusterReconciler struct {
 	client.Client
 	Scheme        *runtime.Scheme
+	Recorder      record.EventRecorder
+	Storages      *storage.Registry
 	ClusterIssuer string
 }
 
 //+kubebuilder:rbac:groups=operator.etcd.io,resources=clusters,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=operator.etcd.io,resources=clusters/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=operator.etcd.io,resources=clusters/finalizers,verbs=update
+//+kubebuilder:rbac:groups=operator.etcd.io,resources=backups,verbs=get;list;watch;create;delete
+//+kubebuilder:rbac:groups=operator.etcd.io,resources=restores,verbs=get;list;watch;create
 //+kubebuilder:rbac:groups="",resources=services,verbs=get;list;watch;create;update
 //+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;delete
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
 //+kubebuilder:rbac:groups=cert-manager.io,resources=certificates,verbs=get;list;watch;create;update
 //+kubebuilder:rbac:groups=cert-manager.io,resources=issuers,verbs=get;list;watch;create;update
+//+kubebuilder:rbac:groups=monitoring.coreos.com,resources=podmonitors,verbs=get;list;watch;create;update;delete
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -63,14 +79,24 @@ func (r *ClusterReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 	if err := r.Get(ctx, req.NamespacedName, &cluster); err != nil {
 		if !errors.IsNotFound(err) {
 			l.Error(err, "unable to fetch cluster")
+		} else {
+			deleteClusterMetrics(req.Namespace, req.Name)
 		}
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
 
 	if cluster.DeletionTimestamp != nil {
+		deleteClusterMetrics(cluster.Namespace, cluster.Name)
+		if result, err := r.FinalizeBackups(ctx, &cluster); err != nil || !result.IsZero() {
+			return result, err
+		}
 		return r.CleanupSecrets(ctx, &cluster)
 	}
 
+	if result, err := r.EnsureFinalizers(ctx, &cluster); err != nil || !result.IsZero() {
+		return result, err
+	}
+
 	if cluster.Status.Phase == "" {
 		cluster.Status.Phase = api.ClusterCreating
 	}
@@ -87,9 +113,30 @@ func (r *ClusterReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 	if result, err := r.EnsureService(ctx, &cluster); err != nil || !result.IsZero() {
 		return result, err
 	}
+	if result, err := r.EnsureMonitoring(ctx, &cluster); err != nil || !result.IsZero() {
+		return result, err
+	}
 	if result, err := r.EnsureCA(ctx, &cluster); err != nil || !result.IsZero() {
 		return result, err
 	}
+	if result, err := r.UpdateBackupCondition(ctx, &cluster); err != nil || !result.IsZero() {
+		return result, err
+	}
+	if cluster.Status.Restore != "" {
+		if !cluster.Status.Fenced {
+			cluster.Status.Phase = api.ClusterRestoring
+			return ctrl.Result{}, nil
+		}
+
+		// members of fenced cluster are restored, but cluster is neither
+		// repaired nor released until restore is finished
+		result, err := r.EnsureMembers(ctx, &cluster)
+		cluster.Status.Phase = api.ClusterRestoring
+		return result, err
+	}
+	if cluster.ForceNewClusterRequested() || cluster.IsForcingNewCluster() {
+		return r.ForceNewCluster(ctx, &cluster)
+	}
 	if result, err := r.EnsureMembers(ctx, &cluster); err != nil || !result.IsZero() {
 		return result, err
 	}
@@ -100,6 +147,12 @@ func (r *ClusterReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 		}
 	}
 
+	if cluster.Status.Phase == api.ClusterFailed && cluster.AutoRecoveryEnabled() {
+		if result, err := r.RecoverFromBackup(ctx, &cluster); err != nil || !result.IsZero() {
+			return result, err
+		}
+	}
+
 	if cluster.ShouldUpdate() {
 		if result, err := r.UpdateMembers(ctx, &cluster); err != nil || !result.IsZero() {
 			return result, err
@@ -114,12 +167,30 @@ func (r *ClusterReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 func (r *ClusterReconciler) EnsureBackupSchedule(ctx context.Context, cluster *api.Cluster) (ctrl.Result, error) {
 	l := log.FromContext(ctx)
 
-	schedule := cluster.GetBackupSchedule()
-	if err := controllerutil.SetControllerReference(cluster, schedule, r.Scheme); err != nil {
-		return ctrl.Result{}, err
+	desired := cluster.GetBackupSchedule()
+	schedule := &api.BackupSchedule{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      desired.Name,
+			Namespace: desired.Namespace,
+		},
 	}
 
-	if _, err := controllerutil.CreateOrUpdate(ctx, r.Client, schedule, SkipUpdate); err != nil {
+	if _, err := controllerutil.CreateOrUpdate(ctx, r.Client, schedule, func() error {
+		if schedule.CreationTimestamp.IsZero() {
+			schedule.Finalizers = desired.Finalizers
+		}
+
+		// suspend, attempts, deadline and retain on delete are not part of
+		// cluster spec and are managed on schedule itself
+		spec := desired.Spec
+		spec.Suspend = schedule.Spec.Suspend
+		spec.MaxAttempts = schedule.Spec.MaxAttempts
+		spec.Deadline = schedule.Spec.Deadline
+		spec.RetainOnDelete = schedule.Spec.RetainOnDelete
+		schedule.Spec = spec
+
+		return controllerutil.SetControllerReference(cluster, schedule, r.Scheme)
+	}); err != nil {
 		l.Error(err, "unable to schedule backups")
 		return ctrl.Result{}, err
 	}
@@ -130,12 +201,35 @@ func (r *ClusterReconciler) EnsureBackupSchedule(ctx context.Context, cluster *a
 func (r *ClusterReconciler) EnsureService(ctx context.Context, cluster *api.Cluster) (ctrl.Result, error) {
 	l := log.FromContext(ctx)
 
-	service := cluster.GetService()
-	if err := controllerutil.SetControllerReference(cluster, service, r.Scheme); err != nil {
-		return ctrl.Result{}, err
+	desired := cluster.GetService()
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      desired.Name,
+			Namespace: desired.Namespace,
+		},
 	}
 
-	if opResult, err := controllerutil.CreateOrUpdate(ctx, r.Client, service, SkipUpdate); err != nil {
+	if opResult, err := controllerutil.CreateOrUpdate(ctx, r.Client, service, func() error {
+		if service.CreationTimestamp.IsZero() {
+			service.Finalizers = desired.Finalizers
+			// cluster IP is immutable, so it is set on creation only
+			service.Spec.ClusterIP = desired.Spec.ClusterIP
+		}
+
+		service.Spec.Selector = desired.Spec.Selector
+		service.Spec.PublishNotReadyAddresses = desired.Spec.PublishNotReadyAddresses
+		// ports are defaulted by API server, defaults are set here as well
+		// to not update unchanged service on every reconcile
+		ports := make([]corev1.ServicePort, len(desired.Spec.Ports))
+		for i, port := range desired.Spec.Ports {
+			port.Protocol = corev1.ProtocolTCP
+			port.TargetPort = intstr.FromInt(int(port.Port))
+			ports[i] = port
+		}
+		service.Spec.Ports = ports
+
+		return controllerutil.SetControllerReference(cluster, service, r.Scheme)
+	}); err != nil {
 		l.Error(err, "unable to create service")
 		return ctrl.Result{}, err
 	} else if opResult == controllerutil.OperationResultCreated {
@@ -145,6 +239,50 @@ func (r *ClusterReconciler) EnsureService(ctx context.Context, cluster *api.Clus
 	return ctrl.Result{}, nil
 }
 
+// EnsureMonitoring keeps PodMonitor of cluster in sync with its monitoring
+// spec, PodMonitor is removed once monitoring is disabled
+func (r *ClusterReconciler) EnsureMonitoring(ctx context.Context, cluster *api.Cluster) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+
+	gvk := api.PodMonitorGroupVersionKind
+	if _, err := r.RESTMapper().RESTMapping(gvk.GroupKind(), gvk.Version); meta.IsNoMatchError(err) {
+		if cluster.MonitoringEnabled() {
+			l.Info("monitoring is enabled, but PodMonitor resource is not installed", "cluster", cluster.Name)
+		}
+		return ctrl.Result{}, nil
+	} else if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	monitor := &unstructured.Unstructured{}
+	monitor.SetGroupVersionKind(gvk)
+	monitor.SetName(cluster.Name)
+	monitor.SetNamespace(cluster.Namespace)
+
+	if !cluster.MonitoringEnabled() {
+		if err := r.Get(ctx, client.ObjectKeyFromObject(monitor), monitor); err != nil {
+			return ctrl.Result{}, client.IgnoreNotFound(err)
+		}
+		if !metav1.IsControlledBy(monitor, cluster) {
+			return ctrl.Result{}, nil
+		}
+
+		return ctrl.Result{}, client.IgnoreNotFound(r.Delete(ctx, monitor))
+	}
+
+	desired := cluster.GetPodMonitor()
+	if _, err := controllerutil.CreateOrUpdate(ctx, r.Client, monitor, func() error {
+		monitor.Object["spec"] = desired.Object["spec"]
+		monitor.SetLabels(desired.GetLabels())
+		return controllerutil.SetControllerReference(cluster, monitor, r.Scheme)
+	}); err != nil {
+		l.Error(err, "unable to create pod monitor")
+		return ctrl.Result{}, err
+	}
+
+	return ctrl.Result{}, nil
+}
+
 func (r *ClusterReconciler) EnsureCA(ctx context.Context, cluster *api.Cluster) (ctrl.Result, error) {
 	if result, err := r.EnsureCACertificate(ctx, cluster); err != nil || !result.IsZero() {
 		return result, err
@@ -221,6 +359,11 @@ func (r *ClusterReconciler) EnsureMembers(ctx context.Context, cluster *api.Clus
 	} else {
 		cluster.Status.Phase = api.ClusterFailed
 	}
+	if cluster.Status.Phase != api.ClusterFailed {
+		cluster.Status.FailedTime = metav1.Time{}
+	} else if cluster.Status.FailedTime.IsZero() {
+		cluster.Status.FailedTime = metav1.Now()
+	}
 	cluster.Status.CertificateExpires = certificateExpires
 
 	return ctrl.Result{}, errs
@@ -325,11 +468,55 @@ func (r *ClusterReconciler) RepairMembers(ctx context.Context, cluster *api.Clus
 	}
 
 	l.Info("starting repair process", "member", failedMember.Name, "namespace", failedMember.Namespace)
+	r.Recorder.Eventf(cluster, corev1.EventTypeWarning, ReasonMemberBroken, "Member %s is marked as broken and will be recreated", failedMember.Name)
+	r.Recorder.Event(failedMember, corev1.EventTypeWarning, ReasonMemberBroken, "Member is marked as broken and will be recreated")
 	failedMember.Spec.Broken = true
 
 	return ctrl.Result{}, r.Update(ctx, failedMember)
 }
 
+// UpdateBackupCondition reflects restore verification of the latest verified
+// backup of cluster in its Verified condition
+func (r *ClusterReconciler) UpdateBackupCondition(ctx context.Context, cluster *api.Cluster) (ctrl.Result, error) {
+	var backups api.BackupList
+	if err := r.List(ctx, &backups, client.InNamespace(cluster.Namespace), client.MatchingLabels{
+		api.ClusterLabel: cluster.Name,
+	}); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	var latest *api.Backup
+	for i, backup := range backups.Items {
+		condition := meta.FindStatusCondition(backup.Status.Conditions, api.BackupVerified)
+		if condition == nil {
+			continue
+		}
+		if latest == nil || backup.Status.LastVerificationTime.After(latest.Status.LastVerificationTime.Time) {
+			latest = &backups.Items[i]
+		}
+	}
+	if latest == nil {
+		return ctrl.Result{}, nil
+	}
+
+	verified := meta.FindStatusCondition(latest.Status.Conditions, api.BackupVerified)
+	meta.SetStatusCondition(&cluster.Status.Conditions, metav1.Condition{
+		Type:               api.BackupVerified,
+		Status:             verified.Status,
+		ObservedGeneration: cluster.Generation,
+		Reason:             verified.Reason,
+		Message:            fmt.Sprintf("Backup %s: %s", latest.Name, verified.Message),
+	})
+
+	value := 0.0
+	if verified.Status == metav1.ConditionTrue {
+		value = 1
+	}
+	clusterBackupVerified.WithLabelValues(cluster.Namespace, cluster.Name).Set(value)
+
+	return ctrl.Result{}, nil
+}
+
 func (r *ClusterReconciler) CleanupSecrets(ctx context.Context, cluster *api.Cluster) (ctrl.Result, error) {
 	if controllerutil.ContainsFinalizer(cluster, metav1.FinalizerDeleteDependents) {
 		return Requeue(), nil
@@ -362,6 +549,14 @@ func (r *ClusterReconciler) SetupWithManager(mgr ctrl.Manager) error {
 		Owns(&corev1.Service{}).
 		Owns(&certv1.Certificate{}).
 		Owns(&certv1.Issuer{}).
+		Watches(&source.Kind{Type: &api.Backup{}}, handler.EnqueueRequestsFromMapFunc(func(obj client.Object) []reconcile.Request {
+			return []reconcile.Request{{
+				NamespacedName: types.NamespacedName{
+					Name:      obj.GetLabels()[api.ClusterLabel],
+					Namespace: obj.GetNamespace(),
+				},
+			}}
+		})).
 		Complete(r)
 }
 
@@ -0,0 +1,194 @@
+/*
+Copyright 2022 Evgenii Omelchenko.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3.
+
+This program is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	api "github.com/elemir/etcdops/api/v1alpha1"
+)
+
+const (
+	// finalBackupPollPeriod is period of checking if final backup is finished
+	finalBackupPollPeriod = 10 * time.Second
+	// finalBackupDeadline limits time cluster deletion waits for final backup
+	finalBackupDeadline = 10 * time.Minute
+)
+
+// EnsureFinalizers adds backup finalizer to clusters which backups should be
+// handled on deletion. Foreground deletion would stop members before final
+// backup is taken, so members of such clusters are removed in background
+func (r *ClusterReconciler) EnsureFinalizers(ctx context.Context, cluster *api.Cluster) (ctrl.Result, error) {
+	updated := false
+
+	switch {
+	case cluster.NeedsBackupFinalizer() && !controllerutil.ContainsFinalizer(cluster, api.BackupFinalizer):
+		controllerutil.AddFinalizer(cluster, api.BackupFinalizer)
+		updated = true
+	case !cluster.NeedsBackupFinalizer() && controllerutil.ContainsFinalizer(cluster, api.BackupFinalizer):
+		controllerutil.RemoveFinalizer(cluster, api.BackupFinalizer)
+		updated = true
+	}
+
+	if cluster.TakesFinalBackup() && controllerutil.ContainsFinalizer(cluster, metav1.FinalizerDeleteDependents) {
+		controllerutil.RemoveFinalizer(cluster, metav1.FinalizerDeleteDependents)
+		updated = true
+	}
+
+	if !updated {
+		return ctrl.Result{}, nil
+	}
+
+	return Requeue(), r.Update(ctx, cluster)
+}
+
+// FinalizeBackups takes final backup of deleted cluster if it is requested
+// and applies backup deletion policy
+func (r *ClusterReconciler) FinalizeBackups(ctx context.Context, cluster *api.Cluster) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+
+	if !controllerutil.ContainsFinalizer(cluster, api.BackupFinalizer) && !controllerutil.ContainsFinalizer(cluster, api.FinalBackupFinalizer) {
+		return ctrl.Result{}, nil
+	}
+
+	final, result, err := r.FinalBackup(ctx, cluster)
+	if err != nil || !result.IsZero() {
+		return result, err
+	}
+
+	if !controllerutil.ContainsFinalizer(cluster, api.BackupFinalizer) {
+		controllerutil.RemoveFinalizer(cluster, api.FinalBackupFinalizer)
+		return Requeue(), r.Update(ctx, cluster)
+	}
+
+	var backups api.BackupList
+	if err := r.List(ctx, &backups, client.InNamespace(cluster.Namespace), client.MatchingLabels{
+		api.ClusterLabel: cluster.Name,
+	}); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	for _, backup := range SelectDeletedBackups(cluster.GetBackupDeletionPolicy(), final, backups.Items) {
+		backup := backup
+		if err := DeleteBackup(ctx, r.Client, r.Storages, &backup); err != nil {
+			l.Error(err, "unable to remove backup of deleted cluster", "backup", backup.Name)
+			return ctrl.Result{}, err
+		}
+		r.Recorder.Eventf(cluster, corev1.EventTypeNormal, ReasonBackupRemoved, "Removed backup %s by %s deletion policy", backup.Name, cluster.GetBackupDeletionPolicy())
+	}
+
+	controllerutil.RemoveFinalizer(cluster, api.BackupFinalizer)
+	controllerutil.RemoveFinalizer(cluster, api.FinalBackupFinalizer)
+	return Requeue(), r.Update(ctx, cluster)
+}
+
+// FinalBackup waits until final backup of cluster is finished and returns it
+// if it is succeeded. Failed final backup is taken again if cluster has final
+// backup finalizer, otherwise cluster deletion continues without it
+func (r *ClusterReconciler) FinalBackup(ctx context.Context, cluster *api.Cluster) (*api.Backup, ctrl.Result, error) {
+	if !cluster.TakesFinalBackup() {
+		return nil, ctrl.Result{}, nil
+	}
+
+	required := controllerutil.ContainsFinalizer(cluster, api.FinalBackupFinalizer)
+	backup, err := r.TakeFinalBackup(ctx, cluster, required)
+	if err != nil {
+		return nil, ctrl.Result{}, err
+	}
+	// failed final backup is being removed before retry
+	if !backup.IsFinished() || backup.DeletionTimestamp != nil {
+		return nil, ctrl.Result{
+			RequeueAfter: finalBackupPollPeriod,
+		}, nil
+	}
+	if backup.IsSucceeded() {
+		return backup, ctrl.Result{}, nil
+	}
+
+	if !required {
+		r.Recorder.Eventf(cluster, corev1.EventTypeWarning, ReasonBackupFailed, "Final backup %s failed: %s", backup.Name, backup.Status.Message)
+		return nil, ctrl.Result{}, nil
+	}
+
+	r.Recorder.Eventf(cluster, corev1.EventTypeWarning, ReasonBackupFailed, "Final backup %s failed, deletion is blocked until it succeeds: %s", backup.Name, backup.Status.Message)
+	if err := DeleteBackup(ctx, r.Client, r.Storages, backup); err != nil {
+		return nil, ctrl.Result{}, err
+	}
+
+	return nil, ctrl.Result{
+		RequeueAfter: finalBackupPollPeriod,
+	}, nil
+}
+
+// TakeFinalBackup creates final backup of cluster unless it exists and
+// returns it. Required final backup is not limited by short deadline
+func (r *ClusterReconciler) TakeFinalBackup(ctx context.Context, cluster *api.Cluster, required bool) (*api.Backup, error) {
+	backup := cluster.GetFinalBackup()
+
+	err := r.Get(ctx, client.ObjectKeyFromObject(backup), backup)
+	if !errors.IsNotFound(err) {
+		return backup, err
+	}
+
+	if !required {
+		backup.Spec.Deadline = finalBackupDeadline
+	}
+	if err := r.Create(ctx, backup); err != nil {
+		return nil, err
+	}
+	r.Recorder.Eventf(cluster, corev1.EventTypeNormal, ReasonBackupCreated, "Taking final backup %s before teardown", backup.Name)
+
+	return backup, nil
+}
+
+// SelectDeletedBackups returns backups of deleted cluster which should be
+// removed by deletion policy, final backup is always kept
+func SelectDeletedBackups(policy api.BackupDeletionPolicy, final *api.Backup, backups []api.Backup) []api.Backup {
+	var latest *api.Backup
+	for i, backup := range backups {
+		if backup.IsSucceeded() && (latest == nil || backup.Status.Finished.After(latest.Status.Finished.Time)) {
+			latest = &backups[i]
+		}
+	}
+
+	var deleted []api.Backup
+	for _, backup := range backups {
+		if backup.DeletionTimestamp != nil || (final != nil && backup.Name == final.Name) {
+			continue
+		}
+
+		switch policy {
+		case api.BackupDeletionDelete:
+			deleted = append(deleted, backup)
+		case api.BackupDeletionRetainLatest:
+			if latest == nil || backup.Name != latest.Name {
+				deleted = append(deleted, backup)
+			}
+		}
+	}
+
+	return deleted
+}
@@ -0,0 +1,288 @@
+/*
+Copyright 2022 Evgenii Omelchenko.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3.
+
+This program is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	api "github.com/elemir/etcdops/api/v1alpha1"
+)
+
+const (
+	forceNewClusterPollPeriod = 10 * time.Second
+)
+
+// ForceNewCluster recovers cluster which lost quorum from its surviving
+// member. It is started by annotation only, since changes not applied by
+// surviving member are lost
+func (r *ClusterReconciler) ForceNewCluster(ctx context.Context, cluster *api.Cluster) (ctrl.Result, error) {
+	if cluster.ForceNewClusterRequested() {
+		return r.StartForceNewCluster(ctx, cluster)
+	}
+
+	cluster.Status.Phase = api.ClusterRecovering
+
+	switch cluster.Status.ForceNewCluster.Phase {
+	case api.ForceNewClusterStarting:
+		return r.WaitForcedMember(ctx, cluster)
+	case api.ForceNewClusterReadding:
+		return r.ReaddMembers(ctx, cluster)
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// StartForceNewCluster selects surviving member with the highest applied
+// index. Recovery is recorded in cluster status before any member is touched
+func (r *ClusterReconciler) StartForceNewCluster(ctx context.Context, cluster *api.Cluster) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+
+	status := &api.ForceNewClusterStatus{
+		Request:   cluster.Annotations[api.ForceNewClusterAnnotation],
+		StartTime: metav1.Now(),
+	}
+
+	if cluster.Status.Phase != api.ClusterFailed {
+		cluster.Status.ForceNewCluster = status
+		status.SetFailed(fmt.Sprintf("cluster is %s, only cluster which lost quorum could be forced", cluster.Status.Phase))
+		r.Recorder.Event(cluster, corev1.EventTypeWarning, ReasonForceNewClusterFailed, status.Message)
+		return ctrl.Result{}, nil
+	}
+
+	survivor, index, err := r.SelectSurvivor(ctx, cluster)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	cluster.Status.ForceNewCluster = status
+	if survivor == "" {
+		status.SetFailed("no member of cluster responds")
+		r.Recorder.Event(cluster, corev1.EventTypeWarning, ReasonForceNewClusterFailed, status.Message)
+		return ctrl.Result{}, nil
+	}
+
+	status.Phase = api.ForceNewClusterStarting
+	status.Member = survivor
+	status.AppliedIndex = index
+	cluster.Status.Phase = api.ClusterRecovering
+	// revisions not applied by survivor are reused, so journal is continued
+	// as new history
+	cluster.Status.History = string(uuid.NewUUID())
+	if err := r.Status().Update(ctx, cluster); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	l.Info("forcing new cluster", "cluster", cluster.Name, "namespace", cluster.Namespace, "member", survivor, "appliedIndex", index)
+	r.Recorder.Eventf(cluster, corev1.EventTypeWarning, ReasonForceNewCluster,
+		"Forcing new cluster from member %s with applied index %d, other members are wiped and re-added", survivor, index)
+
+	return Requeue(), nil
+}
+
+// SelectSurvivor returns member with the highest applied index among members
+// answering status request, it is empty if no member answers
+func (r *ClusterReconciler) SelectSurvivor(ctx context.Context, cluster *api.Cluster) (string, uint64, error) {
+	l := log.FromContext(ctx)
+
+	var survivor string
+	var index uint64
+	for num := 0; num < cluster.Spec.Size; num++ {
+		var member api.Member
+		if err := r.Get(ctx, types.NamespacedName{
+			Name:      cluster.GetMemberName(num),
+			Namespace: cluster.Namespace,
+		}, &member); err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return "", 0, err
+		}
+
+		applied, err := AppliedIndex(ctx, &member)
+		if err != nil {
+			l.Info("skip member not answering status request", "member", member.Name, "error", err.Error())
+			continue
+		}
+		if survivor == "" || applied > index {
+			survivor = member.Name
+			index = applied
+		}
+	}
+
+	return survivor, index, nil
+}
+
+// AppliedIndex returns raft index applied by member, it is answered without
+// quorum
+func AppliedIndex(ctx context.Context, member *api.Member) (uint64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	etcd, err := NewMemberClient(ctx, member)
+	if err != nil {
+		return 0, err
+	}
+	defer etcd.Close()
+
+	status, err := etcd.Status(ctx, member.GetAdvertiseClientURL())
+	if err != nil {
+		return 0, err
+	}
+
+	return status.RaftAppliedIndex, nil
+}
+
+// WaitForcedMember restarts surviving member as new single-member cluster and
+// waits until it is running
+func (r *ClusterReconciler) WaitForcedMember(ctx context.Context, cluster *api.Cluster) (ctrl.Result, error) {
+	status := cluster.Status.ForceNewCluster
+
+	var survivor api.Member
+	if err := r.Get(ctx, types.NamespacedName{
+		Name:      status.Member,
+		Namespace: cluster.Namespace,
+	}, &survivor); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if !survivor.Spec.ForceNewCluster {
+		survivor.Spec.ForceNewCluster = true
+		return Requeue(), r.Update(ctx, &survivor)
+	}
+	if survivor.Status.ForceNewCluster != api.MemberForceNewClusterCompleted || survivor.Status.Phase != api.MemberRunning {
+		return ctrl.Result{
+			RequeueAfter: forceNewClusterPollPeriod,
+		}, nil
+	}
+
+	r.Recorder.Eventf(cluster, corev1.EventTypeNormal, ReasonForceNewCluster, "Member %s is running as new single-member cluster", survivor.Name)
+	status.Phase = api.ForceNewClusterReadding
+
+	return Requeue(), nil
+}
+
+// ReaddMembers wipes and re-adds members to recovered cluster one by one.
+// Joining member is started with initial cluster of already joined members
+// only, since etcd rejects initial cluster which differs from member list.
+// Every member is wiped once, recovery fails if re-added member doesn't join
+func (r *ClusterReconciler) ReaddMembers(ctx context.Context, cluster *api.Cluster) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+	status := cluster.Status.ForceNewCluster
+
+	etcd, err := NewClusterClient(ctx, cluster)
+	if err != nil {
+		l.Error(err, "failed to instanate etcd client")
+		return ctrl.Result{}, err
+	}
+	defer etcd.Close()
+
+	listCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	resp, err := etcd.MemberList(listCtx)
+	if err != nil {
+		l.Error(err, "failed to get member list")
+		return ctrl.Result{}, err
+	}
+
+	// unstarted members have no name yet
+	started := make(map[string]bool)
+	for _, m := range resp.Members {
+		if m.Name != "" {
+			started[m.Name] = true
+		}
+	}
+
+	members := make([]api.Member, cluster.Spec.Size)
+	joined := []string{status.Member}
+	for num := range members {
+		member := &members[num]
+		if err := r.Get(ctx, types.NamespacedName{
+			Name:      cluster.GetMemberName(num),
+			Namespace: cluster.Namespace,
+		}, member); err != nil {
+			return ctrl.Result{}, err
+		}
+		if member.Name == status.Member {
+			continue
+		}
+
+		if started[member.Name] && member.Status.Phase == api.MemberRunning && !member.Spec.Broken {
+			joined = append(joined, member.Name)
+			continue
+		}
+		// joining member is waited for until it fails
+		if status.Joining == member.Name && (member.Spec.Broken || member.Status.Phase != api.MemberFailed) {
+			return ctrl.Result{
+				RequeueAfter: forceNewClusterPollPeriod,
+			}, nil
+		}
+
+		if status.IsReadded(member.Name) {
+			status.Joining = ""
+			status.SetFailed(fmt.Sprintf("member %s is re-added, but doesn't join recovered cluster, it should be repaired manually", member.Name))
+			r.Recorder.Event(cluster, corev1.EventTypeWarning, ReasonForceNewClusterFailed, status.Message)
+			return ctrl.Result{}, nil
+		}
+
+		// joining member is recorded first, so member is never wiped twice
+		status.Joining = member.Name
+		status.Readded = append(status.Readded, member.Name)
+		if err := r.Status().Update(ctx, cluster); err != nil {
+			return ctrl.Result{}, err
+		}
+
+		l.Info("re-adding member to recovered cluster", "member", member.Name, "namespace", member.Namespace)
+		r.Recorder.Eventf(cluster, corev1.EventTypeNormal, ReasonForceNewCluster, "Member %s is wiped and re-added to recovered cluster", member.Name)
+		member.Spec.Members = append(append([]string{}, joined...), member.Name)
+		member.Spec.Broken = true
+		if err := r.Update(ctx, member); err != nil {
+			return ctrl.Result{}, err
+		}
+
+		return ctrl.Result{
+			RequeueAfter: forceNewClusterPollPeriod,
+		}, nil
+	}
+
+	// pods of joined members are not recreated on spec update, so full
+	// member list is safe to return
+	for num := range members {
+		member := &members[num]
+		member.Spec.Members = cluster.GetMember(num).Spec.Members
+		member.Spec.ForceNewCluster = false
+		if err := r.Update(ctx, member); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	l.Info("recovered cluster from surviving member", "cluster", cluster.Name, "namespace", cluster.Namespace, "member", status.Member)
+	r.Recorder.Eventf(cluster, corev1.EventTypeNormal, ReasonForceNewClusterDone, "Recovered cluster from member %s", status.Member)
+	status.Phase = api.ForceNewClusterCompleted
+	status.Joining = ""
+	status.CompletionTime = metav1.Now()
+
+	return Requeue(), nil
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2022 Evgenii Omelchenko.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3.
+
+This program is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package controllers
+
+import (
+	"context"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	api "github.com/elemir/etcdops/api/v1alpha1"
+)
+
+const (
+	// recoveryRetryPeriod is period of looking for verified backup when
+	// failed cluster has none
+	recoveryRetryPeriod = time.Minute
+)
+
+// RecoverFromBackup restores cluster which stays failed longer than grace
+// period from its newest verified backup. Recovery is recorded in cluster
+// status before restore is created, so every failure is recovered once
+func (r *ClusterReconciler) RecoverFromBackup(ctx context.Context, cluster *api.Cluster) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+
+	if cluster.IsRecovering() {
+		return ctrl.Result{}, r.CreateRecoveryRestore(ctx, cluster)
+	}
+
+	recoverAt := cluster.Status.FailedTime.Add(cluster.Spec.AutoRecovery.GetGracePeriod())
+	if wait := time.Until(recoverAt); wait > 0 {
+		return ctrl.Result{
+			RequeueAfter: wait,
+		}, nil
+	}
+
+	backup, err := r.LatestVerifiedBackup(ctx, cluster)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if backup == nil {
+		l.Info("no verified backup to recover cluster from", "cluster", cluster.Name, "namespace", cluster.Namespace)
+		r.Recorder.Event(cluster, corev1.EventTypeWarning, ReasonRecoveryFailed, "Cluster lost quorum and has no verified backup to be recovered from")
+		return ctrl.Result{
+			RequeueAfter: recoveryRetryPeriod,
+		}, nil
+	}
+
+	// changes made while snapshot was streamed are not guaranteed to be in
+	// it, so window is counted from the start of snapshot
+	backupTime := backup.GetSnapshotTime()
+	window := cluster.Status.FailedTime.Sub(backupTime.Time)
+	if window < 0 {
+		window = 0
+	}
+	cluster.Status.Recovery = &api.RecoveryStatus{
+		Restore:        cluster.GetRecoveryRestore(backup.Name).Name,
+		Backup:         backup.Name,
+		BackupTime:     backupTime,
+		FailedTime:     cluster.Status.FailedTime,
+		DataLossWindow: metav1.Duration{Duration: window},
+	}
+	if err := r.Status().Update(ctx, cluster); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	l.Info("starting automatic recovery", "cluster", cluster.Name, "namespace", cluster.Namespace, "backup", backup.Name, "dataLossWindow", window)
+	r.Recorder.Eventf(cluster, corev1.EventTypeWarning, ReasonRecoveryStarted,
+		"Cluster lost quorum at %s and is recovered from backup %s taken at %s, changes made during %s before failure are lost",
+		cluster.Status.FailedTime.UTC().Format(time.RFC3339), backup.Name, backupTime.UTC().Format(time.RFC3339), window.Round(time.Second))
+
+	return ctrl.Result{}, r.CreateRecoveryRestore(ctx, cluster)
+}
+
+// CreateRecoveryRestore creates restore recorded in cluster recovery status
+// unless it exists
+func (r *ClusterReconciler) CreateRecoveryRestore(ctx context.Context, cluster *api.Cluster) error {
+	restore := cluster.GetRecoveryRestore(cluster.Status.Recovery.Backup)
+	if err := controllerutil.SetControllerReference(cluster, restore, r.Scheme); err != nil {
+		return err
+	}
+
+	if err := r.Create(ctx, restore); err != nil && !errors.IsAlreadyExists(err) {
+		return err
+	}
+
+	return nil
+}
+
+// LatestVerifiedBackup returns the newest succeeded snapshot of cluster which
+// passed restore verification
+func (r *ClusterReconciler) LatestVerifiedBackup(ctx context.Context, cluster *api.Cluster) (*api.Backup, error) {
+	var backups api.BackupList
+	if err := r.List(ctx, &backups, client.InNamespace(cluster.Namespace), client.MatchingLabels{
+		api.ClusterLabel: cluster.Name,
+	}); err != nil {
+		return nil, err
+	}
+
+	var latest *api.Backup
+	for i, backup := range backups.Items {
+		if backup.DeletionTimestamp != nil || !backup.IsSucceeded() || backup.GetType() != api.BackupTypeSnapshot {
+			continue
+		}
+		if !meta.IsStatusConditionTrue(backup.Status.Conditions, api.BackupVerified) {
+			continue
+		}
+		if latest == nil || backup.GetSnapshotTime().After(latest.GetSnapshotTime().Time) {
+			latest = &backups.Items[i]
+		}
+	}
+
+	return latest, nil
+}
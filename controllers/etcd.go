@@ -0,0 +1,61 @@
+/*
+Copyright 2022 Evgenii Omelchenko.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3.
+
+This program is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/tls"
+	"time"
+
+	"github.com/go-logr/zapr"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	api "github.com/elemir/etcdops/api/v1alpha1"
+)
+
+// NewClusterClient returns etcd client connected to all members of cluster
+func NewClusterClient(ctx context.Context, cluster *api.Cluster) (*clientv3.Client, error) {
+	var endpoints []string
+	for num := 0; num < cluster.Spec.Size; num++ {
+		endpoints = append(endpoints, api.AdvertiseClientURL(cluster.GetMemberName(num), cluster.Namespace, cluster.Name))
+	}
+
+	return newEtcdClient(ctx, endpoints)
+}
+
+// NewMemberClient returns etcd client connected to single member only, it is
+// used for requests answered by member regardless of quorum
+func NewMemberClient(ctx context.Context, member *api.Member) (*clientv3.Client, error) {
+	return newEtcdClient(ctx, []string{member.GetAdvertiseClientURL()})
+}
+
+func newEtcdClient(ctx context.Context, endpoints []string) (*clientv3.Client, error) {
+	etcdConfig := clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: 5 * time.Second,
+		TLS: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+	}
+
+	if zapLogger, ok := log.FromContext(ctx).GetSink().(zapr.Underlier); ok {
+		etcdConfig.Logger = zapLogger.GetUnderlying()
+	}
+
+	return clientv3.New(etcdConfig)
+}
@@ -0,0 +1,42 @@
+/*
+Copyright 2022 Evgenii Omelchenko.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3.
+
+This program is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+// Reasons of events emitted by controllers
+const (
+	ReasonMemberBroken     = "MemberBroken"
+	ReasonMemberRemoved    = "MemberRemoved"
+	ReasonMemberAdded      = "MemberAdded"
+	ReasonPodDeleted       = "PodDeleted"
+	ReasonPVCDeleted       = "PVCDeleted"
+	ReasonBackupCreated    = "BackupCreated"
+	ReasonBackupFailed     = "BackupFailed"
+	ReasonBackupSucceeded  = "BackupSucceeded"
+	ReasonBackupVerified   = "BackupVerified"
+	ReasonBackupCorrupted  = "BackupCorrupted"
+	ReasonBackupRemoved    = "BackupRemoved"
+	ReasonBackupReplicated = "BackupReplicated"
+	ReasonRestoreStarted   = "RestoreStarted"
+	ReasonRestoreFailed    = "RestoreFailed"
+	ReasonRestoreDone      = "RestoreCompleted"
+	ReasonRecoveryStarted  = "RecoveryStarted"
+	ReasonRecoveryFailed   = "RecoveryFailed"
+
+	ReasonForceNewCluster       = "ForceNewCluster"
+	ReasonForceNewClusterFailed = "ForceNewClusterFailed"
+	ReasonForceNewClusterDone   = "ForceNewClusterCompleted"
+)
@@ -0,0 +1,251 @@
+/*
+Copyright 2022 Evgenii Omelchenko.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3.
+
+This program is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	api "github.com/elemir/etcdops/api/v1alpha1"
+	"github.com/elemir/etcdops/pkg/export"
+	"github.com/elemir/etcdops/pkg/storage"
+)
+
+// ImportManager imports keys of export backups into clusters. Every import
+// is run by its own goroutine, so long imports don't block restore
+// reconciler, which is notified once import is finished
+type ImportManager struct {
+	client.Client
+	Storages *storage.Registry
+	// Updates notifies restore reconciler about finished imports
+	Updates chan event.GenericEvent
+
+	mu      sync.Mutex
+	ctx     context.Context
+	imports map[types.NamespacedName]*restoreImport
+}
+
+type restoreImport struct {
+	cancel context.CancelFunc
+	result *ImportResult
+}
+
+// ImportResult is result of finished import
+type ImportResult struct {
+	Stats *export.Stats
+	Err   error
+	// Retry is true if backup is not imported because of transient error,
+	// no keys are written then
+	Retry bool
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable
+func (m *ImportManager) NeedLeaderElection() bool {
+	return true
+}
+
+// Start implements manager.Runnable
+func (m *ImportManager) Start(ctx context.Context) error {
+	m.mu.Lock()
+	m.ctx = log.IntoContext(ctx, log.FromContext(ctx).WithName("import"))
+	m.imports = make(map[types.NamespacedName]*restoreImport)
+	m.mu.Unlock()
+
+	<-ctx.Done()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, i := range m.imports {
+		i.cancel()
+	}
+	m.imports = nil
+
+	return nil
+}
+
+// Ensure starts import of backup into cluster requested by restore, it
+// returns nil until import is finished. Result of finished import is
+// returned once
+func (m *ImportManager) Ensure(restore *api.Restore, cluster *api.Cluster, backup *api.Backup) (*ImportResult, error) {
+	key := types.NamespacedName{
+		Name:      restore.Name,
+		Namespace: restore.Namespace,
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.ctx == nil {
+		return nil, fmt.Errorf("import manager is not started")
+	}
+
+	i, ok := m.imports[key]
+	if !ok {
+		ctx, cancel := context.WithCancel(log.IntoContext(m.ctx, log.FromContext(m.ctx).WithValues("restore", key)))
+		i = &restoreImport{
+			cancel: cancel,
+		}
+		m.imports[key] = i
+		go m.run(ctx, restore.DeepCopy(), cluster.DeepCopy(), backup.DeepCopy(), i)
+
+		return nil, nil
+	}
+
+	if i.result == nil {
+		return nil, nil
+	}
+
+	i.cancel()
+	delete(m.imports, key)
+	return i.result, nil
+}
+
+// Stop interrupts import requested by restore
+func (m *ImportManager) Stop(key types.NamespacedName) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if i, ok := m.imports[key]; ok {
+		i.cancel()
+		delete(m.imports, key)
+	}
+}
+
+func (m *ImportManager) run(ctx context.Context, restore *api.Restore, cluster *api.Cluster, backup *api.Backup, i *restoreImport) {
+	result := m.importBackup(ctx, restore, cluster, backup)
+	if ctx.Err() != nil {
+		return
+	}
+	if result.Err != nil {
+		log.FromContext(ctx).Error(result.Err, "unable to import backup", "backup", backup.Name)
+	}
+
+	m.mu.Lock()
+	i.result = result
+	m.mu.Unlock()
+
+	select {
+	case m.Updates <- event.GenericEvent{Object: restore}:
+	case <-ctx.Done():
+	}
+}
+
+func (m *ImportManager) importBackup(ctx context.Context, restore *api.Restore, cluster *api.Cluster, backup *api.Backup) *ImportResult {
+	staged, err := m.stageBackup(ctx, backup)
+	if err != nil {
+		return &ImportResult{
+			Err:   fmt.Errorf("unable to download backup: %w", err),
+			Retry: true,
+		}
+	}
+	defer os.Remove(staged.Name())
+
+	if err := checkStagedBackup(staged, backup); err != nil {
+		staged.Close()
+		return &ImportResult{
+			Err: err,
+		}
+	}
+
+	reader, err := DecodeBackup(ctx, m.Client, backup, staged)
+	if err != nil {
+		staged.Close()
+		return &ImportResult{
+			Err:   fmt.Errorf("unable to decode backup: %w", err),
+			Retry: true,
+		}
+	}
+	defer reader.Close()
+
+	etcd, err := NewClusterClient(ctx, cluster)
+	if err != nil {
+		return &ImportResult{
+			Err:   fmt.Errorf("unable to connect to cluster: %w", err),
+			Retry: true,
+		}
+	}
+	defer etcd.Close()
+
+	stats, err := export.Import(ctx, etcd, reader, restore.Spec.Prefixes)
+	return &ImportResult{
+		Stats: stats,
+		Err:   err,
+	}
+}
+
+// stageBackup downloads stored backup into local file, it is imported only
+// after checksum of the whole object is checked
+func (m *ImportManager) stageBackup(ctx context.Context, backup *api.Backup) (*os.File, error) {
+	backupStorage, err := GetBackupStorage(ctx, m.Client, m.Storages, backup)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := backupStorage.Download(ctx, backup.GetStorageKey())
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	staged, err := os.CreateTemp("", "import-*")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(staged, body); err != nil {
+		staged.Close()
+		os.Remove(staged.Name())
+		return nil, err
+	}
+
+	return staged, nil
+}
+
+// checkStagedBackup compares size and checksum of staged backup with the
+// ones recorded on upload and rewinds it. Imported backups have no checksum,
+// so only their size is compared
+func checkStagedBackup(staged *os.File, backup *api.Backup) error {
+	if _, err := staged.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, staged)
+	if err != nil {
+		return err
+	}
+
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	switch {
+	case backup.Status.Size != 0 && size != backup.Status.Size:
+		return fmt.Errorf("stored object has %d bytes, expected %d", size, backup.Status.Size)
+	case backup.Status.Checksum != "" && checksum != backup.Status.Checksum:
+		return fmt.Errorf("stored object has checksum %s, expected %s", checksum, backup.Status.Checksum)
+	}
+
+	_, err = staged.Seek(0, io.SeekStart)
+	return err
+}
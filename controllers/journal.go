@@ -0,0 +1,542 @@
+/*
+Copyright 2022 Evgenii Omelchenko.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3.
+
+This program is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	api "github.com/elemir/etcdops/api/v1alpha1"
+	"github.com/elemir/etcdops/pkg/journal"
+	"github.com/elemir/etcdops/pkg/snapshot"
+	"github.com/elemir/etcdops/pkg/storage"
+)
+
+const (
+	// journalRetryPeriod is delay before interrupted journal is restarted
+	journalRetryPeriod = 30 * time.Second
+	// journalPrunePeriod is period of removing segments older than all
+	// backups of cluster
+	journalPrunePeriod = time.Hour
+	// journalFlushTimeout limits upload of buffered changes on shutdown
+	journalFlushTimeout = 10 * time.Second
+)
+
+// JournalManager streams changes of clusters with enabled journal into
+// backup storages. Journal of every cluster is written by its own goroutine,
+// which is started and stopped by schedule reconciler
+type JournalManager struct {
+	client.Client
+	Storages *storage.Registry
+	// Updates notifies schedule reconciler about changes of journal status
+	Updates chan event.GenericEvent
+
+	mu       sync.Mutex
+	ctx      context.Context
+	journals map[types.NamespacedName]*clusterJournal
+}
+
+type clusterJournal struct {
+	cancel context.CancelFunc
+	status api.JournalStatus
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable
+func (m *JournalManager) NeedLeaderElection() bool {
+	return true
+}
+
+// Start implements manager.Runnable
+func (m *JournalManager) Start(ctx context.Context) error {
+	m.mu.Lock()
+	m.ctx = log.IntoContext(ctx, log.FromContext(ctx).WithName("journal"))
+	m.journals = make(map[types.NamespacedName]*clusterJournal)
+	m.mu.Unlock()
+
+	<-ctx.Done()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, j := range m.journals {
+		j.cancel()
+	}
+	m.journals = nil
+
+	return nil
+}
+
+// Ensure starts journal of schedule cluster if it is enabled and stops it
+// otherwise, it returns the latest status of running journal
+func (m *JournalManager) Ensure(schedule *api.BackupSchedule) (*api.JournalStatus, error) {
+	key := types.NamespacedName{
+		Name:      schedule.Name,
+		Namespace: schedule.Namespace,
+	}
+
+	if !schedule.JournalEnabled() || schedule.DeletionTimestamp != nil {
+		m.Stop(key)
+		return nil, nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.ctx == nil {
+		return nil, fmt.Errorf("journal manager is not started")
+	}
+
+	j, ok := m.journals[key]
+	if !ok {
+		ctx, cancel := context.WithCancel(log.IntoContext(m.ctx, log.FromContext(m.ctx).WithValues("schedule", key)))
+		j = &clusterJournal{
+			cancel: cancel,
+		}
+		m.journals[key] = j
+		go m.run(ctx, key, j)
+	}
+
+	status := j.status
+	return &status, nil
+}
+
+// Stop stops journal of schedule cluster
+func (m *JournalManager) Stop(key types.NamespacedName) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if j, ok := m.journals[key]; ok {
+		j.cancel()
+		delete(m.journals, key)
+	}
+}
+
+func (m *JournalManager) updateStatus(ctx context.Context, key types.NamespacedName, j *clusterJournal, update func(*api.JournalStatus)) {
+	m.mu.Lock()
+	update(&j.status)
+	m.mu.Unlock()
+
+	if m.Updates == nil {
+		return
+	}
+
+	select {
+	case m.Updates <- event.GenericEvent{
+		Object: &api.BackupSchedule{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      key.Name,
+				Namespace: key.Namespace,
+			},
+		},
+	}:
+	case <-ctx.Done():
+	}
+}
+
+func (m *JournalManager) run(ctx context.Context, key types.NamespacedName, j *clusterJournal) {
+	l := log.FromContext(ctx)
+
+	for {
+		err := m.Stream(ctx, key, j)
+		if ctx.Err() != nil {
+			return
+		}
+
+		l.Error(err, "journal is interrupted")
+		m.updateStatus(ctx, key, j, func(status *api.JournalStatus) {
+			status.Error = err.Error()
+		})
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(journalRetryPeriod):
+		}
+	}
+}
+
+// Stream watches changes of cluster from the latest journaled revision or
+// from revision of the latest backup and uploads them as segments. Journal
+// is written for the current history of cluster only, it is stopped once
+// history is changed by restoration or forced new cluster
+func (m *JournalManager) Stream(ctx context.Context, key types.NamespacedName, j *clusterJournal) error {
+	l := log.FromContext(ctx)
+
+	var schedule api.BackupSchedule
+	if err := m.Get(ctx, key, &schedule); err != nil {
+		return err
+	}
+	var cluster api.Cluster
+	if err := m.Get(ctx, key, &cluster); err != nil {
+		return err
+	}
+	history := cluster.GetHistory()
+	if err := m.checkHistory(ctx, key, history); err != nil {
+		return err
+	}
+
+	backupStorage, err := GetBackupStorage(ctx, m.Client, m.Storages, schedule.GetBackup())
+	if err != nil {
+		return err
+	}
+
+	revision, err := m.StartRevision(ctx, &schedule, backupStorage, history)
+	if err != nil {
+		return err
+	}
+	if revision == 0 {
+		return fmt.Errorf("cluster has no succeeded backups of history %s to start journal from", history)
+	}
+
+	writer := &segmentWriter{
+		storage: backupStorage,
+		cluster: cluster.Name,
+		history: history,
+		next:    revision + 1,
+	}
+	if encryption := schedule.Spec.Encryption; encryption != nil {
+		writer.keyID = encryption.KeyID
+		writer.key, err = GetEncryptionKey(ctx, m.Client, schedule.Namespace, encryption, encryption.KeyID)
+		if err != nil {
+			return err
+		}
+	}
+
+	etcd, err := NewClusterClient(ctx, &cluster)
+	if err != nil {
+		return err
+	}
+	defer etcd.Close()
+
+	flush := func(ctx context.Context) error {
+		last, err := writer.Flush(ctx)
+		if err != nil || last == 0 {
+			return err
+		}
+
+		m.updateStatus(ctx, key, j, func(status *api.JournalStatus) {
+			status.Revision = last
+			status.Time = metav1.Now()
+			status.Error = ""
+		})
+		return nil
+	}
+	// changes buffered before stop are uploaded even if journal is stopped
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), journalFlushTimeout)
+		defer cancel()
+
+		if err := flush(ctx); err != nil {
+			l.Error(err, "unable to upload the last journal segment")
+		}
+	}()
+
+	l.Info("starting journal", "revision", revision, "history", history)
+	watchCtx, cancel := context.WithCancel(clientv3.WithRequireLeader(ctx))
+	defer cancel()
+	changes := etcd.Watch(watchCtx, "", clientv3.WithPrefix(), clientv3.WithRev(revision+1))
+
+	ticker := time.NewTicker(schedule.Spec.Journal.GetSegmentPeriod())
+	defer ticker.Stop()
+
+	var pruned time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if err := flush(ctx); err != nil {
+				return err
+			}
+		case resp, ok := <-changes:
+			if !ok {
+				return fmt.Errorf("watch is closed")
+			}
+			if err := resp.Err(); err != nil {
+				return fmt.Errorf("unable to watch changes since revision %d: %w", writer.next, err)
+			}
+			// changes of restored cluster must not be mixed into journal
+			if err := m.checkHistory(ctx, key, history); err != nil {
+				return err
+			}
+
+			now := time.Now()
+			for _, change := range resp.Events {
+				if err := writer.Add(change, now); err != nil {
+					return err
+				}
+			}
+
+			if writer.Size() >= schedule.Spec.Journal.GetSegmentSize() {
+				if err := flush(ctx); err != nil {
+					return err
+				}
+			}
+		}
+
+		if time.Since(pruned) >= journalPrunePeriod {
+			pruned = time.Now()
+			if err := m.Prune(ctx, &schedule, backupStorage); err != nil {
+				l.Error(err, "unable to remove stale journal segments")
+			}
+		}
+	}
+}
+
+// checkHistory returns error if cluster is being restored or its history
+// differs from journaled one
+func (m *JournalManager) checkHistory(ctx context.Context, key types.NamespacedName, history string) error {
+	var cluster api.Cluster
+	if err := m.Get(ctx, key, &cluster); err != nil {
+		return err
+	}
+
+	if cluster.Status.Restore != "" || cluster.IsForcingNewCluster() {
+		return fmt.Errorf("cluster is being recovered")
+	}
+	if cluster.GetHistory() != history {
+		return fmt.Errorf("cluster history is changed from %s to %s", history, cluster.GetHistory())
+	}
+
+	return nil
+}
+
+// StartRevision returns revision journal of cluster history continues from,
+// it is either the latest journaled revision or revision of the latest
+// succeeded backup of the same history
+func (m *JournalManager) StartRevision(ctx context.Context, schedule *api.BackupSchedule, backupStorage storage.BackupStorage, history string) (int64, error) {
+	segments, err := ListJournalSegments(ctx, backupStorage, journal.HistoryPrefix(schedule.Name, history))
+	if err != nil {
+		return 0, err
+	}
+
+	var revision int64
+	if len(segments) > 0 {
+		revision = segments[len(segments)-1].Last
+	}
+
+	backups, err := m.listSnapshots(ctx, schedule)
+	if err != nil {
+		return 0, err
+	}
+	for _, backup := range backups {
+		// journal couldn't be continued, so it starts from the newer backup
+		if backup.Status.History == history && backup.Status.Revision > revision {
+			revision = backup.Status.Revision
+		}
+	}
+
+	return revision, nil
+}
+
+// Prune removes journal segments preceding revisions of all succeeded backups
+// of their history, they couldn't be replayed onto any snapshot. Segments of
+// histories without backups are removed entirely
+func (m *JournalManager) Prune(ctx context.Context, schedule *api.BackupSchedule, backupStorage storage.BackupStorage) error {
+	backups, err := m.listSnapshots(ctx, schedule)
+	if err != nil || len(backups) == 0 {
+		return err
+	}
+
+	oldest := make(map[string]int64)
+	for _, backup := range backups {
+		if revision, ok := oldest[backup.Status.History]; !ok || backup.Status.Revision < revision {
+			oldest[backup.Status.History] = backup.Status.Revision
+		}
+	}
+
+	segments, err := ListJournalSegments(ctx, backupStorage, journal.ClusterPrefix(schedule.Name))
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		if revision, ok := oldest[segment.History]; ok && segment.Last > revision {
+			continue
+		}
+		if err := backupStorage.Delete(ctx, segment.Key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// listSnapshots returns succeeded snapshot backups of schedule cluster with
+// known revisions
+func (m *JournalManager) listSnapshots(ctx context.Context, schedule *api.BackupSchedule) ([]api.Backup, error) {
+	var backups api.BackupList
+	if err := m.List(ctx, &backups, client.InNamespace(schedule.Namespace), client.MatchingLabels{
+		api.ClusterLabel: schedule.Name,
+	}); err != nil {
+		return nil, err
+	}
+
+	var snapshots []api.Backup
+	for _, backup := range backups.Items {
+		if backup.IsSucceeded() && backup.GetType() == api.BackupTypeSnapshot && backup.Status.Revision > 0 {
+			snapshots = append(snapshots, backup)
+		}
+	}
+
+	return snapshots, nil
+}
+
+// ListJournalSegments returns journal segments stored under prefix ordered
+// by their revisions
+func ListJournalSegments(ctx context.Context, backupStorage storage.BackupStorage, prefix string) ([]journal.Segment, error) {
+	objects, err := backupStorage.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []journal.Segment
+	for _, object := range objects {
+		if segment, ok := journal.ParseSegmentKey(object.Key); ok {
+			segments = append(segments, segment)
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].First < segments[j].First
+	})
+
+	return segments, nil
+}
+
+// OpenJournalSegment downloads stored journal segment, decrypts and
+// decompresses it
+func OpenJournalSegment(ctx context.Context, c client.Client, backupStorage storage.BackupStorage, namespace string, encryption *api.EncryptionSpec, segment journal.Segment) (io.ReadCloser, error) {
+	var key []byte
+	if segment.KeyID != "" {
+		if encryption == nil {
+			return nil, fmt.Errorf("journal segment %s is encrypted but there is no encryption key secret", segment.Key)
+		}
+
+		var err error
+		key, err = GetEncryptionKey(ctx, c, namespace, encryption, segment.KeyID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	body, err := backupStorage.Download(ctx, segment.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	var decrypted io.Reader = body
+	if key != nil {
+		decrypted, err = snapshot.Decrypt(body, key)
+		if err != nil {
+			body.Close()
+			return nil, err
+		}
+	}
+
+	decompressed, err := snapshot.Decompress(decrypted, snapshot.CompressionZstd)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+
+	return &backupReader{
+		ReadCloser: decompressed,
+		body:       body,
+	}, nil
+}
+
+// segmentWriter buffers changes of cluster and uploads them as journal
+// segments
+type segmentWriter struct {
+	storage storage.BackupStorage
+	cluster string
+	history string
+	key     []byte
+	keyID   string
+
+	// next is the first revision of the next segment
+	next   int64
+	last   int64
+	buffer bytes.Buffer
+}
+
+func (w *segmentWriter) Add(change *clientv3.Event, received time.Time) error {
+	event := journal.Event{
+		Type:     journal.EventPut,
+		Key:      change.Kv.Key,
+		Value:    change.Kv.Value,
+		Lease:    change.Kv.Lease,
+		Revision: change.Kv.ModRevision,
+		Time:     received,
+	}
+	if change.Type == clientv3.EventTypeDelete {
+		event.Type = journal.EventDelete
+		event.Value = nil
+	}
+
+	w.last = event.Revision
+	return json.NewEncoder(&w.buffer).Encode(event)
+}
+
+func (w *segmentWriter) Size() int64 {
+	return int64(w.buffer.Len())
+}
+
+// Flush uploads buffered changes as segment and returns its last revision,
+// nothing is uploaded if there are no changes
+func (w *segmentWriter) Flush(ctx context.Context) (int64, error) {
+	if w.buffer.Len() == 0 {
+		return 0, nil
+	}
+
+	compressed, err := snapshot.Compress(bytes.NewReader(w.buffer.Bytes()), snapshot.CompressionZstd)
+	if err != nil {
+		return 0, err
+	}
+	defer compressed.Close()
+
+	var body io.Reader = compressed
+	if w.key != nil {
+		encrypted, err := snapshot.Encrypt(compressed, w.key)
+		if err != nil {
+			return 0, err
+		}
+		defer encrypted.Close()
+		body = encrypted
+	}
+
+	key := journal.SegmentKey(w.cluster, w.history, w.next, w.last, w.keyID)
+	if _, err := w.storage.Upload(ctx, key, body, storage.UploadOptions{}); err != nil {
+		return 0, fmt.Errorf("unable to upload journal segment %s: %w", key, err)
+	}
+
+	w.next = w.last + 1
+	w.buffer.Reset()
+
+	return w.last, nil
+}
@@ -31,17 +31,22 @@ import (
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 
 	api "github.com/elemir/etcdops/api/v1alpha1"
+	"github.com/elemir/etcdops/pkg/storage"
 )
 
 // MemberReconciler reconciles a Member object
 type MemberReconciler struct {
 	client.Client
-	Scheme *runtime.Scheme
+	Scheme       *runtime.Scheme
+	Recorder     record.EventRecorder
+	Storages     *storage.Registry
+	FetcherImage string
 }
 
 //+kubebuilder:rbac:groups=operator.etcd.io,resources=members,verbs=get;list;watch;create;update;patch;delete
@@ -49,6 +54,8 @@ type MemberReconciler struct {
 //+kubebuilder:rbac:groups=operator.etcd.io,resources=members/finalizers,verbs=update
 //+kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch;create;update;delete
 //+kubebuilder:rbac:groups="",resources=persistentvolumeclaims,verbs=get;list;watch;create;update;delete
+//+kubebuilder:rbac:groups=operator.etcd.io,resources=backups,verbs=get;list;watch
+//+kubebuilder:rbac:groups=operator.etcd.io,resources=backupstoragelocations,verbs=get;list;watch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -78,6 +85,13 @@ func (r *MemberReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctr
 			return result, err
 		}
 	}
+	if member.Spec.ForceNewCluster {
+		if result, err := r.ForceNewCluster(ctx, &member); err != nil || !result.IsZero() {
+			return result, err
+		}
+	} else {
+		member.Status.ForceNewCluster = ""
+	}
 
 	if result, err := r.EnsureCertificates(ctx, &member); err != nil || !result.IsZero() {
 		return result, err
@@ -158,6 +172,17 @@ func (r *MemberReconciler) EnsurePod(ctx context.Context, member *api.Member) (c
 		return ctrl.Result{}, err
 	}
 
+	if member.ShouldRestore() {
+		fetch, volumes, err := GetFetchContainer(ctx, r.Client, r.Storages, r.FetcherImage, member)
+		if err != nil {
+			l.Error(err, "unable to prepare backup fetching")
+			r.SetRestoreFailed(member, err.Error())
+			return ctrl.Result{}, err
+		}
+		pod.Spec.InitContainers = append([]corev1.Container{*fetch}, pod.Spec.InitContainers...)
+		pod.Spec.Volumes = append(pod.Spec.Volumes, volumes...)
+	}
+
 	if opResult, err := controllerutil.CreateOrUpdate(ctx, r.Client, pod, SkipUpdate); err != nil {
 		l.Error(err, "unable to create pod")
 		return ctrl.Result{}, err
@@ -173,6 +198,10 @@ func (r *MemberReconciler) EnsurePod(ctx context.Context, member *api.Member) (c
 		ready = ready && status.Ready
 	}
 
+	if member.ShouldRestore() {
+		r.UpdateRestoreStatus(member, pod, ready)
+	}
+
 	if member.Status.Phase == api.MemberRunning && !ready {
 		member.SetFailed()
 	} else if ready {
@@ -183,6 +212,46 @@ func (r *MemberReconciler) EnsurePod(ctx context.Context, member *api.Member) (c
 	return ctrl.Result{}, nil
 }
 
+func (r *MemberReconciler) UpdateRestoreStatus(member *api.Member, pod *corev1.Pod, ready bool) {
+	if ready {
+		member.Status.RestorePhase = api.MemberRestoreCompleted
+		member.Status.RestoreMessage = ""
+		r.Recorder.Eventf(member, corev1.EventTypeNormal, ReasonRestoreDone, "Restored member from backup %s", member.Spec.Backup)
+		return
+	}
+
+	for _, status := range pod.Status.InitContainerStatuses {
+		if status.Ready {
+			continue
+		}
+
+		terminated := status.State.Terminated
+		if terminated == nil && status.State.Waiting != nil {
+			terminated = status.LastTerminationState.Terminated
+		}
+		if terminated != nil && terminated.ExitCode != 0 {
+			r.SetRestoreFailed(member, terminated.Message)
+			return
+		}
+
+		member.Status.RestorePhase = api.MemberRestoreDownloading
+		if status.Name == api.RestoreContainerName {
+			member.Status.RestorePhase = api.MemberRestoreRestoring
+		}
+		member.Status.RestoreMessage = ""
+		return
+	}
+}
+
+func (r *MemberReconciler) SetRestoreFailed(member *api.Member, message string) {
+	if member.Status.RestorePhase != api.MemberRestoreFailed {
+		r.Recorder.Eventf(member, corev1.EventTypeWarning, ReasonRestoreFailed, "Unable to restore member from backup %s: %s", member.Spec.Backup, message)
+	}
+
+	member.Status.RestorePhase = api.MemberRestoreFailed
+	member.Status.RestoreMessage = message
+}
+
 func (r *MemberReconciler) CheckCertificateExpires(ctx context.Context, member *api.Member) (ctrl.Result, error) {
 	l := log.FromContext(ctx)
 
@@ -243,6 +312,42 @@ func (r *MemberReconciler) Repair(ctx context.Context, member *api.Member) (ctrl
 	return ctrl.Result{}, nil
 }
 
+// ForceNewCluster restarts member with --force-new-cluster flag, so it
+// becomes single-member cluster keeping its data. Running member is restarted
+// once more without the flag, otherwise every pod restart would drop members
+// re-added to cluster
+func (r *MemberReconciler) ForceNewCluster(ctx context.Context, member *api.Member) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+
+	switch member.Status.ForceNewCluster {
+	case "":
+		if result, err := r.DeletePod(ctx, member); err != nil || !result.IsZero() {
+			return result, err
+		}
+
+		l.Info("starting member as new cluster", "member", member.Name, "namespace", member.Namespace)
+		r.Recorder.Event(member, corev1.EventTypeWarning, ReasonForceNewCluster, "Starting member as new single-member cluster")
+		member.Status.ForceNewCluster = api.MemberForceNewClusterStarting
+		member.Status.Phase = api.MemberUpdating
+
+		return Requeue(), nil
+	case api.MemberForceNewClusterStarting:
+		if member.Status.Phase != api.MemberRunning {
+			return ctrl.Result{}, nil
+		}
+		if result, err := r.DeletePod(ctx, member); err != nil || !result.IsZero() {
+			return result, err
+		}
+
+		member.Status.ForceNewCluster = api.MemberForceNewClusterCompleted
+		member.Status.Phase = api.MemberUpdating
+
+		return Requeue(), nil
+	}
+
+	return ctrl.Result{}, nil
+}
+
 func (r *MemberReconciler) ReaddToCluster(ctx context.Context, member *api.Member) (ctrl.Result, error) {
 	l := log.FromContext(ctx)
 
@@ -285,6 +390,7 @@ func (r *MemberReconciler) ReaddToCluster(ctx context.Context, member *api.Membe
 			return ctrl.Result{}, err
 		}
 		l.Info("removed broken member from cluster", "member", member.Name, "namespace", member.Namespace)
+		r.Recorder.Eventf(member, corev1.EventTypeWarning, ReasonMemberRemoved, "Removed member %x from etcd cluster", m.ID)
 	}
 
 	_, err = etcd.MemberAdd(ctx, []string{
@@ -294,6 +400,7 @@ func (r *MemberReconciler) ReaddToCluster(ctx context.Context, member *api.Membe
 		l.Error(err, "failed to add new version of member")
 		return ctrl.Result{}, err
 	}
+	r.Recorder.Event(member, corev1.EventTypeNormal, ReasonMemberAdded, "Added new version of member to etcd cluster")
 
 	return ctrl.Result{}, nil
 }
@@ -312,6 +419,7 @@ func (r *MemberReconciler) DeletePod(ctx context.Context, member *api.Member) (c
 		return ctrl.Result{}, nil
 	}
 	l.Info("removed member's pod", "member", member.Name, "namespace", member.Namespace)
+	r.Recorder.Event(member, corev1.EventTypeNormal, ReasonPodDeleted, "Deleted member's pod for restart")
 
 	return Requeue(), nil
 }
@@ -330,6 +438,7 @@ func (r *MemberReconciler) DeletePVC(ctx context.Context, member *api.Member) (c
 		return ctrl.Result{}, nil
 	}
 	l.Info("removed broken member's pvc", "member", member.Name, "namespace", member.Namespace)
+	r.Recorder.Event(member, corev1.EventTypeWarning, ReasonPVCDeleted, "Deleted broken member's data volume")
 
 	return Requeue(), nil
 }
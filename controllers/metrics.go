@@ -0,0 +1,47 @@
+/*
+Copyright 2022 Evgenii Omelchenko.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3.
+
+This program is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	backupVerifications = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "etcdops_backup_verifications_total",
+		Help: "Number of backup restore verifications by result",
+	}, []string{"namespace", "cluster", "result"})
+
+	clusterBackupVerified = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "etcdops_cluster_backup_verified",
+		Help: "Whether the latest verified backup of cluster is restorable",
+	}, []string{"namespace", "cluster"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(backupVerifications, clusterBackupVerified)
+}
+
+// deleteClusterMetrics removes series of deleted cluster, so they are not
+// exported until operator restart
+func deleteClusterMetrics(namespace, cluster string) {
+	clusterBackupVerified.DeleteLabelValues(namespace, cluster)
+	for _, result := range []string{"succeeded", "failed"} {
+		backupVerifications.DeleteLabelValues(namespace, cluster, result)
+	}
+}
@@ -0,0 +1,281 @@
+/*
+Copyright 2022 Evgenii Omelchenko.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3.
+
+This program is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"context"
+	"path"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	api "github.com/elemir/etcdops/api/v1alpha1"
+	"github.com/elemir/etcdops/pkg/storage"
+)
+
+const (
+	orphanScanPeriod = time.Hour
+	// orphanMinAge protects snapshots whose backups are being created
+	orphanMinAge = time.Hour
+	// retainedPrefix is a folder of markers of snapshots retained on backup
+	// deletion, it couldn't clash with folder of any cluster
+	retainedPrefix = ".retained"
+)
+
+// FindOrphans returns keys of stored snapshots without matching backups. Only
+// objects with keys of backup snapshots format <cluster>/<backup> are checked,
+// nested keys are never orphans: journal segments are pruned by journal
+// manager and other keys could belong to storages with nested prefixes.
+// Snapshots retained on backup deletion are not orphans either
+func FindOrphans(ctx context.Context, backupStorage storage.BackupStorage, backups []api.Backup) ([]string, error) {
+	known, err := retainedKeys(ctx, backupStorage)
+	if err != nil {
+		return nil, err
+	}
+	for _, backup := range backups {
+		known[backup.GetStorageKey()] = true
+	}
+
+	objects, err := backupStorage.List(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var orphans []string
+	for _, object := range objects {
+		if strings.Count(object.Key, "/") != 1 || known[object.Key] || time.Since(object.LastModified) < orphanMinAge {
+			continue
+		}
+		orphans = append(orphans, object.Key)
+	}
+
+	return orphans, nil
+}
+
+// CollectOrphans finds stored snapshots without matching backups and removes
+// them if requested
+func CollectOrphans(ctx context.Context, backupStorage storage.BackupStorage, backups []api.Backup, remove bool) ([]string, error) {
+	l := log.FromContext(ctx)
+
+	orphans, err := FindOrphans(ctx, backupStorage, backups)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range orphans {
+		if !remove {
+			l.Info("found orphaned backup snapshot", "key", key)
+			continue
+		}
+
+		if err := backupStorage.Delete(ctx, key); err != nil {
+			return nil, err
+		}
+		l.Info("removed orphaned backup snapshot", "key", key)
+	}
+
+	return orphans, nil
+}
+
+// MarkRetained records that snapshot of deleted backup is retained on
+// purpose in its storage and replica locations, so it is never collected as
+// orphan. Removed locations are skipped
+func MarkRetained(ctx context.Context, c client.Client, storages *storage.Registry, backup *api.Backup) error {
+	var backupStorages []storage.BackupStorage
+
+	backupStorage, err := GetBackupStorage(ctx, c, storages, backup)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	} else if err == nil {
+		backupStorages = append(backupStorages, backupStorage)
+	}
+	for _, location := range backup.Spec.Replicas {
+		replicaStorage, err := getReplicaStorage(ctx, c, backup.Namespace, location)
+		if errors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		backupStorages = append(backupStorages, replicaStorage)
+	}
+
+	for _, backupStorage := range backupStorages {
+		if _, err := backupStorage.Upload(ctx, path.Join(retainedPrefix, backup.GetStorageKey()), strings.NewReader(""), storage.UploadOptions{}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// retainedKeys returns keys of snapshots retained on backup deletion
+func retainedKeys(ctx context.Context, backupStorage storage.BackupStorage) (map[string]bool, error) {
+	objects, err := backupStorage.List(ctx, retainedPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	retained := make(map[string]bool)
+	for _, object := range objects {
+		retained[strings.TrimPrefix(object.Key, retainedPrefix+"/")] = true
+	}
+
+	return retained, nil
+}
+
+// SharedBackups returns backups of all namespaces stored in storages which
+// share objects with S3 storage of given config, that is in operator storages
+// and storage locations with the same endpoint, bucket and prefix
+func SharedBackups(ctx context.Context, c client.Client, storages *storage.Registry, config storage.S3Config) ([]api.Backup, error) {
+	key := locationKey(config)
+
+	var locations api.BackupStorageLocationList
+	if err := c.List(ctx, &locations); err != nil {
+		return nil, err
+	}
+	sharedLocations := make(map[types.NamespacedName]bool)
+	for i := range locations.Items {
+		if locationKey(getLocationConfig(&locations.Items[i])) == key {
+			sharedLocations[client.ObjectKeyFromObject(&locations.Items[i])] = true
+		}
+	}
+
+	sharedStorages := make(map[string]bool)
+	for name, backupStorage := range storages.Storages {
+		if s3Storage, ok := backupStorage.(*storage.S3Storage); ok && locationKey(s3Storage.S3Config) == key {
+			sharedStorages[name] = true
+		}
+	}
+
+	var backups api.BackupList
+	if err := c.List(ctx, &backups); err != nil {
+		return nil, err
+	}
+
+	var stored []api.Backup
+	for _, backup := range backups.Items {
+		shared := backup.Spec.StorageLocation == "" && sharedStorages[storageName(&backup, storages)]
+		for _, location := range append([]string{backup.Spec.StorageLocation}, backup.Spec.Replicas...) {
+			shared = shared || sharedLocations[types.NamespacedName{
+				Namespace: backup.Namespace,
+				Name:      location,
+			}]
+		}
+
+		if shared {
+			stored = append(stored, backup)
+		}
+	}
+
+	return stored, nil
+}
+
+// locationKey identifies objects of S3 storage, storages with the same
+// endpoint, bucket and prefix share their objects
+func locationKey(config storage.S3Config) string {
+	return strings.Join([]string{config.Endpoint, config.Bucket, strings.Trim(config.Prefix, "/")}, "|")
+}
+
+// storageName returns name of operator storage backup is stored in
+func storageName(backup *api.Backup, storages *storage.Registry) string {
+	if backup.Spec.Storage == "" {
+		return storages.Default
+	}
+
+	return backup.Spec.Storage
+}
+
+// OrphanCollector periodically looks for orphaned snapshots in backup
+// storages configured by operator flags, snapshots of backup storage
+// locations are checked by their reconciler
+type OrphanCollector struct {
+	client.Client
+	Storages *storage.Registry
+	Delete   bool
+	// ImportNamespace is namespace orphaned snapshots are imported into as
+	// backups, they are not imported if it is empty
+	ImportNamespace string
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable
+func (c *OrphanCollector) NeedLeaderElection() bool {
+	return true
+}
+
+// Start implements manager.Runnable
+func (c *OrphanCollector) Start(ctx context.Context) error {
+	ctx = log.IntoContext(ctx, log.FromContext(ctx).WithName("orphan-collector"))
+
+	ticker := time.NewTicker(orphanScanPeriod)
+	defer ticker.Stop()
+
+	for {
+		c.Collect(ctx)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *OrphanCollector) Collect(ctx context.Context) {
+	l := log.FromContext(ctx)
+
+	var backups api.BackupList
+	if err := c.List(ctx, &backups); err != nil {
+		l.Error(err, "unable to list backups")
+		return
+	}
+
+	for name, backupStorage := range c.Storages.Storages {
+		var stored []api.Backup
+		if s3Storage, ok := backupStorage.(*storage.S3Storage); ok {
+			var err error
+			stored, err = SharedBackups(ctx, c.Client, c.Storages, s3Storage.S3Config)
+			if err != nil {
+				l.Error(err, "unable to list backups", "storage", name)
+				continue
+			}
+		} else {
+			for _, backup := range backups.Items {
+				if backup.Spec.StorageLocation == "" && storageName(&backup, c.Storages) == name {
+					stored = append(stored, backup)
+				}
+			}
+		}
+
+		if c.ImportNamespace != "" {
+			if err := ImportBackups(ctx, c.Client, backupStorage, stored, c.ImportNamespace, api.BackupSpec{
+				Storage: name,
+			}); err != nil {
+				l.Error(err, "unable to import backups", "storage", name)
+			}
+			continue
+		}
+
+		if _, err := CollectOrphans(ctx, backupStorage, stored, c.Delete); err != nil {
+			l.Error(err, "unable to collect orphaned snapshots", "storage", name)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+/*
+Copyright 2022 Evgenii Omelchenko.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3.
+
+This program is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	api "github.com/elemir/etcdops/api/v1alpha1"
+	"github.com/elemir/etcdops/pkg/snapshot"
+	"github.com/elemir/etcdops/pkg/storage"
+)
+
+// replicationRetryPeriod is delay before failed copy to replica location is
+// retried
+const replicationRetryPeriod = 5 * time.Minute
+
+// Replicate copies stored backup to its replica locations, copies failed
+// previously are retried
+func (r *BackupReconciler) Replicate(ctx context.Context, backup *api.Backup) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+
+	if !backup.IsSucceeded() || len(backup.Spec.Replicas) == 0 {
+		return ctrl.Result{}, nil
+	}
+
+	var result ctrl.Result
+	for _, location := range backup.Spec.Replicas {
+		replica := backup.GetReplicaStatus(location)
+		if replica.Phase == api.BackupSucceeded {
+			continue
+		}
+
+		url, err := r.CopyToReplica(ctx, backup, location)
+		if err != nil {
+			l.Error(err, "unable to copy backup to replica location", "location", location)
+			r.Recorder.Eventf(backup, corev1.EventTypeWarning, ReasonBackupFailed, "Unable to copy backup to replica location %s: %v", location, err)
+			replica.Phase = api.BackupFailed
+			replica.Message = err.Error()
+			result = Earliest(result, ctrl.Result{
+				RequeueAfter: replicationRetryPeriod,
+			})
+			continue
+		}
+
+		replica.Phase = api.BackupSucceeded
+		replica.Message = ""
+		replica.URL = url
+		replica.Finished = metav1.Now()
+		r.Recorder.Eventf(backup, corev1.EventTypeNormal, ReasonBackupReplicated, "Backup is copied to replica location %s", location)
+	}
+
+	return result, nil
+}
+
+// CopyToReplica copies stored backup as is to replica location and checks
+// that copy matches the original, copy which doesn't match is removed
+func (r *BackupReconciler) CopyToReplica(ctx context.Context, backup *api.Backup, location string) (string, error) {
+	backupStorage, err := GetBackupStorage(ctx, r.Client, r.Storages, backup)
+	if err != nil {
+		return "", err
+	}
+	replicaStorage, err := getReplicaStorage(ctx, r.Client, backup.Namespace, location)
+	if err != nil {
+		return "", err
+	}
+
+	body, err := backupStorage.Download(ctx, backup.GetStorageKey())
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	hash := sha256.New()
+	copied := &snapshot.CountingReader{Reader: io.TeeReader(body, hash)}
+	retainUntil := replicaStorage.LockUntil(backup.CreationTimestamp.Time, backup.Spec.RetentionPeriod)
+	url, err := replicaStorage.Upload(ctx, backup.GetStorageKey(), copied, storage.UploadOptions{
+		RetainUntil: retainUntil,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var mismatch error
+	if backup.Status.Size > 0 && copied.Count != backup.Status.Size {
+		mismatch = fmt.Errorf("copied %d bytes, but stored backup has %d bytes", copied.Count, backup.Status.Size)
+	} else if sum := hex.EncodeToString(hash.Sum(nil)); backup.Status.Checksum != "" && sum != backup.Status.Checksum {
+		mismatch = fmt.Errorf("copied object has checksum %s, expected %s", sum, backup.Status.Checksum)
+	}
+	if mismatch != nil {
+		if err := replicaStorage.Delete(ctx, backup.GetStorageKey()); err != nil {
+			// locked copy could not be removed until its retention ends
+			backup.Lock(retainUntil)
+			return "", fmt.Errorf("%v, unable to remove bad copy: %w", mismatch, err)
+		}
+		return "", mismatch
+	}
+	backup.Lock(retainUntil)
+
+	return url, nil
+}
+
+// DeleteReplicas removes copies of backup from its replica locations, copies
+// in removed locations are skipped
+func DeleteReplicas(ctx context.Context, c client.Client, backup *api.Backup) error {
+	for _, location := range backup.Spec.Replicas {
+		replicaStorage, err := getReplicaStorage(ctx, c, backup.Namespace, location)
+		if errors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := replicaStorage.Delete(ctx, backup.GetStorageKey()); err != nil {
+			return fmt.Errorf("unable to remove copy from replica location %s: %w", location, err)
+		}
+	}
+
+	return nil
+}
+
+func getReplicaStorage(ctx context.Context, c client.Client, namespace, name string) (storage.BackupStorage, error) {
+	var location api.BackupStorageLocation
+	if err := c.Get(ctx, types.NamespacedName{
+		Name:      name,
+		Namespace: namespace,
+	}, &location); err != nil {
+		return nil, err
+	}
+
+	return GetLocationStorage(ctx, c, &location)
+}
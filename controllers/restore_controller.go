@@ -0,0 +1,489 @@
+/*
+Copyright 2022 Evgenii Omelchenko.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3.
+
+This program is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	api "github.com/elemir/etcdops/api/v1alpha1"
+	"github.com/elemir/etcdops/pkg/journal"
+	"github.com/elemir/etcdops/pkg/storage"
+)
+
+const (
+	restorePollPeriod = 10 * time.Second
+)
+
+// RestoreReconciler reconciles a Restore object
+type RestoreReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+	Storages *storage.Registry
+	Imports  *ImportManager
+}
+
+//+kubebuilder:rbac:groups=operator.etcd.io,resources=restores,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=operator.etcd.io,resources=restores/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=operator.etcd.io,resources=restores/finalizers,verbs=update
+//+kubebuilder:rbac:groups=operator.etcd.io,resources=clusters/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=operator.etcd.io,resources=members,verbs=get;list;watch;delete
+//+kubebuilder:rbac:groups="",resources=persistentvolumeclaims,verbs=get;list;watch;delete
+
+// Reconcile is part of the main kubernetes reconciliation loop which aims to
+// move the current state of the cluster closer to the desired state.
+func (r *RestoreReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+
+	var restore api.Restore
+	if err := r.Get(ctx, req.NamespacedName, &restore); err != nil {
+		if !apierrors.IsNotFound(err) {
+			l.Error(err, "unable to fetch restore")
+		} else {
+			r.Imports.Stop(req.NamespacedName)
+		}
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	if restore.DeletionTimestamp != nil || restore.IsFinished() {
+		r.Imports.Stop(req.NamespacedName)
+		return ctrl.Result{}, nil
+	}
+
+	defer func() {
+		if err := r.Status().Update(ctx, &restore); err != nil && !apierrors.IsConflict(err) {
+			l.Error(err, "unable to update restore")
+		}
+	}()
+
+	if restore.Status.Phase == "" {
+		restore.Status.Phase = api.RestorePending
+		restore.Status.StartTime = metav1.Now()
+	}
+
+	var cluster api.Cluster
+	if err := r.Get(ctx, types.NamespacedName{
+		Name:      restore.Spec.Cluster,
+		Namespace: restore.Namespace,
+	}, &cluster); err != nil {
+		if apierrors.IsNotFound(err) {
+			restore.SetFailed(fmt.Sprintf("cluster %s not found", restore.Spec.Cluster))
+		}
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	switch restore.Status.Phase {
+	case api.RestorePending:
+		return r.Start(ctx, &restore, &cluster)
+	case api.RestoreStoppingMembers:
+		return r.StopMembers(ctx, &restore, &cluster)
+	case api.RestoreWipingVolumes:
+		return r.WipeVolumes(ctx, &restore, &cluster)
+	case api.RestoreRestoring:
+		return r.WaitRestored(ctx, &restore, &cluster)
+	case api.RestoreImporting:
+		return r.Import(ctx, &restore, &cluster)
+	case api.RestoreReplaying:
+		return r.Replay(ctx, &restore, &cluster)
+	}
+
+	return ctrl.Result{}, nil
+}
+
+func (r *RestoreReconciler) Start(ctx context.Context, restore *api.Restore, cluster *api.Cluster) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+
+	var backup api.Backup
+	if err := r.Get(ctx, types.NamespacedName{
+		Name:      restore.Spec.Backup,
+		Namespace: restore.Namespace,
+	}, &backup); err != nil {
+		if apierrors.IsNotFound(err) {
+			restore.SetFailed(fmt.Sprintf("backup %s not found", restore.Spec.Backup))
+		}
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	if !backup.IsSucceeded() {
+		restore.SetFailed(fmt.Sprintf("backup %s is not succeeded", backup.Name))
+		return ctrl.Result{}, nil
+	}
+
+	if cluster.Status.Restore != "" && cluster.Status.Restore != restore.Name {
+		restore.SetFailed(fmt.Sprintf("cluster is already being restored by %s", cluster.Status.Restore))
+		return ctrl.Result{}, nil
+	}
+
+	if restore.IsPointInTime() && (backup.GetType() != api.BackupTypeSnapshot || backup.Status.Revision == 0 || backup.Status.History == "") {
+		restore.SetFailed(fmt.Sprintf("backup %s has no snapshot revision journal could be replayed onto", backup.Name))
+		return ctrl.Result{}, nil
+	}
+	// revision recorded on backup creation is only a lower bound of snapshot
+	// revision, the real one is recorded on upload or restore verification
+	if restore.IsPointInTime() && backup.Status.SnapshotRevision == 0 {
+		restore.SetFailed(fmt.Sprintf("snapshot revision of backup %s is unknown, it should pass restore verification first", backup.Name))
+		return ctrl.Result{}, nil
+	}
+	if len(restore.Spec.Prefixes) > 0 && backup.GetType() != api.BackupTypeExport {
+		restore.SetFailed(fmt.Sprintf("backup %s is a snapshot, only keys of export backups could be limited by prefixes", backup.Name))
+		return ctrl.Result{}, nil
+	}
+	if restore.Spec.Revision > 0 && restore.Spec.Revision < backup.Status.SnapshotRevision {
+		restore.SetFailed(fmt.Sprintf("backup %s contains revision %d, it is newer than requested revision %d", backup.Name, backup.Status.SnapshotRevision, restore.Spec.Revision))
+		return ctrl.Result{}, nil
+	}
+
+	if backup.GetType() == api.BackupTypeExport {
+		l.Info("starting import", "cluster", cluster.Name, "backup", backup.Name)
+		r.Recorder.Eventf(cluster, corev1.EventTypeNormal, ReasonRestoreStarted, "Importing keys from backup %s", backup.Name)
+		restore.Status.Phase = api.RestoreImporting
+
+		return Requeue(), nil
+	}
+
+	cluster.Status.Restore = restore.Name
+	cluster.Status.Phase = api.ClusterRestoring
+	if err := r.Status().Update(ctx, cluster); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	l.Info("starting in-place restore", "cluster", cluster.Name, "backup", backup.Name)
+	r.Recorder.Eventf(cluster, corev1.EventTypeWarning, ReasonRestoreStarted, "Restoring cluster in place from backup %s", backup.Name)
+	restore.Status.Phase = api.RestoreStoppingMembers
+
+	return Requeue(), nil
+}
+
+func (r *RestoreReconciler) StopMembers(ctx context.Context, restore *api.Restore, cluster *api.Cluster) (ctrl.Result, error) {
+	stopped := true
+
+	for i := 0; i < cluster.Spec.Size; i++ {
+		var member api.Member
+		if err := r.Get(ctx, types.NamespacedName{
+			Name:      cluster.GetMemberName(i),
+			Namespace: cluster.Namespace,
+		}, &member); err != nil {
+			if !apierrors.IsNotFound(err) {
+				return ctrl.Result{}, err
+			}
+			continue
+		}
+
+		stopped = false
+		if member.DeletionTimestamp == nil {
+			if err := r.Delete(ctx, &member); client.IgnoreNotFound(err) != nil {
+				return ctrl.Result{}, err
+			}
+		}
+	}
+
+	if !stopped {
+		return ctrl.Result{
+			RequeueAfter: restorePollPeriod,
+		}, nil
+	}
+
+	restore.Status.Phase = api.RestoreWipingVolumes
+
+	return Requeue(), nil
+}
+
+func (r *RestoreReconciler) WipeVolumes(ctx context.Context, restore *api.Restore, cluster *api.Cluster) (ctrl.Result, error) {
+	var pvcs corev1.PersistentVolumeClaimList
+
+	if err := r.List(ctx, &pvcs, client.InNamespace(cluster.Namespace), client.MatchingLabels{
+		"name": cluster.Name,
+	}); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if len(pvcs.Items) > 0 {
+		for _, pvc := range pvcs.Items {
+			if pvc.DeletionTimestamp != nil {
+				continue
+			}
+			if err := r.Delete(ctx, &pvc); client.IgnoreNotFound(err) != nil {
+				return ctrl.Result{}, err
+			}
+		}
+
+		return ctrl.Result{
+			RequeueAfter: restorePollPeriod,
+		}, nil
+	}
+
+	cluster.Status.ClusterToken = string(restore.UID)
+	cluster.Status.History = string(restore.UID)
+	cluster.Status.RestoredBackup = restore.Spec.Backup
+	// cluster restored to point in time is kept fenced until journal is
+	// replayed, clients could change it otherwise
+	cluster.Status.Fenced = restore.IsPointInTime()
+	if !cluster.Status.Fenced {
+		cluster.Status.Restore = ""
+		cluster.Status.Phase = api.ClusterCreating
+	}
+	if err := r.Status().Update(ctx, cluster); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	restore.Status.Phase = api.RestoreRestoring
+
+	return Requeue(), nil
+}
+
+func (r *RestoreReconciler) WaitRestored(ctx context.Context, restore *api.Restore, cluster *api.Cluster) (ctrl.Result, error) {
+	var members api.MemberList
+
+	if err := r.List(ctx, &members, client.InNamespace(cluster.Namespace)); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	running := 0
+	for _, member := range members.Items {
+		if member.Spec.ClusterName != cluster.Name {
+			continue
+		}
+		if member.Status.Phase == api.MemberRunning {
+			running++
+		}
+		if member.Status.RestorePhase != api.MemberRestoreFailed {
+			continue
+		}
+
+		if err := r.releaseCluster(ctx, cluster); err != nil {
+			return ctrl.Result{}, err
+		}
+		restore.SetFailed(fmt.Sprintf("member %s: %s", member.Name, member.Status.RestoreMessage))
+		r.Recorder.Eventf(cluster, corev1.EventTypeWarning, ReasonRestoreFailed, "Unable to restore cluster from backup %s", restore.Spec.Backup)
+
+		return ctrl.Result{}, nil
+	}
+
+	// fenced cluster stays restoring, so its members are checked instead
+	if running < cluster.Spec.Size {
+		return ctrl.Result{
+			RequeueAfter: restorePollPeriod,
+		}, nil
+	}
+
+	if restore.IsPointInTime() {
+		restore.Status.Phase = api.RestoreReplaying
+		return Requeue(), nil
+	}
+
+	restore.Status.Phase = api.RestoreCompleted
+	restore.Status.CompletionTime = metav1.Now()
+	r.Recorder.Eventf(cluster, corev1.EventTypeNormal, ReasonRestoreDone, "Restored cluster from backup %s", restore.Spec.Backup)
+
+	return ctrl.Result{}, nil
+}
+
+// Replay applies journal of backup cluster onto restored snapshot up to
+// requested revision or time
+func (r *RestoreReconciler) Replay(ctx context.Context, restore *api.Restore, cluster *api.Cluster) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+
+	var backup api.Backup
+	if err := r.Get(ctx, types.NamespacedName{
+		Name:      restore.Spec.Backup,
+		Namespace: restore.Namespace,
+	}, &backup); err != nil {
+		if apierrors.IsNotFound(err) {
+			restore.SetFailed(fmt.Sprintf("backup %s not found", restore.Spec.Backup))
+		}
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	backupStorage, err := GetBackupStorage(ctx, r.Client, r.Storages, &backup)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	segments, err := ListJournalSegments(ctx, backupStorage, journal.HistoryPrefix(backup.Labels[api.ClusterLabel], backup.Status.History))
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	etcd, err := NewClusterClient(ctx, cluster)
+	if err != nil {
+		l.Error(err, "failed to instanate etcd client")
+		return ctrl.Result{}, err
+	}
+	defer etcd.Close()
+
+	target := journal.Target{
+		Revision: restore.Spec.Revision,
+	}
+	if restore.Spec.Time != nil {
+		target.Time = restore.Spec.Time.Time
+	}
+
+	// segments are read since recorded revision, so changes contained in
+	// snapshot are checked against target too. Replay interrupted by error
+	// is resumed from the last applied revision
+	revision := backup.Status.SnapshotRevision
+	skip := backup.Status.Revision
+	if restore.Status.Revision > revision {
+		revision = restore.Status.Revision
+		skip = revision
+	}
+	restore.Status.Revision = revision
+	reached := false
+	for _, segment := range segments {
+		if segment.Last <= skip {
+			continue
+		}
+		if segment.First > revision+1 {
+			return r.failReplay(ctx, restore, cluster, fmt.Sprintf("journal has no changes between revisions %d and %d", revision, segment.First))
+		}
+
+		reader, err := OpenJournalSegment(ctx, r.Client, backupStorage, backup.Namespace, backup.Spec.Encryption, segment)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		result, err := journal.Replay(ctx, etcd, reader, revision, target)
+		reader.Close()
+		revision = result.Revision
+		restore.Status.Revision = revision
+		if errors.Is(err, journal.ErrNotReplayable) {
+			return r.failReplay(ctx, restore, cluster, err.Error())
+		} else if err != nil {
+			l.Error(err, "unable to replay journal segment", "segment", segment.Key)
+			return ctrl.Result{}, err
+		}
+
+		if result.Reached || (target.Revision > 0 && revision >= target.Revision) {
+			reached = true
+			break
+		}
+	}
+
+	// target is not reached if it is after the last journaled change
+	reached = reached || (target.Revision > 0 && revision >= target.Revision)
+	if !reached && target.Revision > 0 {
+		return r.failReplay(ctx, restore, cluster, fmt.Sprintf("journal ends at revision %d before requested revision %d", revision, target.Revision))
+	}
+	if !reached {
+		return r.failReplay(ctx, restore, cluster, fmt.Sprintf("journal ends at revision %d before requested time %s", revision, target.Time.Format(time.RFC3339)))
+	}
+
+	if err := r.releaseCluster(ctx, cluster); err != nil {
+		return ctrl.Result{}, err
+	}
+	restore.Status.Phase = api.RestoreCompleted
+	restore.Status.Message = fmt.Sprintf("Replayed journal up to revision %d", revision)
+	restore.Status.CompletionTime = metav1.Now()
+	r.Recorder.Eventf(cluster, corev1.EventTypeNormal, ReasonRestoreDone, "Restored cluster from backup %s and journal up to revision %d", restore.Spec.Backup, revision)
+
+	return ctrl.Result{}, nil
+}
+
+func (r *RestoreReconciler) failReplay(ctx context.Context, restore *api.Restore, cluster *api.Cluster, message string) (ctrl.Result, error) {
+	if err := r.releaseCluster(ctx, cluster); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	restore.SetFailed(fmt.Sprintf("cluster is restored from backup %s up to revision %d, but %s", restore.Spec.Backup, restore.Status.Revision, message))
+	r.Recorder.Eventf(cluster, corev1.EventTypeWarning, ReasonRestoreFailed, "Unable to replay journal onto backup %s: %s", restore.Spec.Backup, message)
+
+	return ctrl.Result{}, nil
+}
+
+// releaseCluster finishes restore of fenced cluster, so it is used by clients
+// and repaired again
+func (r *RestoreReconciler) releaseCluster(ctx context.Context, cluster *api.Cluster) error {
+	if !cluster.Status.Fenced {
+		return nil
+	}
+
+	cluster.Status.Restore = ""
+	cluster.Status.Fenced = false
+	cluster.Status.Phase = api.ClusterCreating
+
+	return r.Status().Update(ctx, cluster)
+}
+
+// Import puts keys of export backup into running cluster, existing keys
+// outside of export are kept. Keys are imported by import manager, backup is
+// checked against its recorded checksum before any key is written
+func (r *RestoreReconciler) Import(ctx context.Context, restore *api.Restore, cluster *api.Cluster) (ctrl.Result, error) {
+	l := log.FromContext(ctx)
+
+	if cluster.Status.Phase != api.ClusterRunning {
+		return ctrl.Result{
+			RequeueAfter: restorePollPeriod,
+		}, nil
+	}
+
+	var backup api.Backup
+	if err := r.Get(ctx, types.NamespacedName{
+		Name:      restore.Spec.Backup,
+		Namespace: restore.Namespace,
+	}, &backup); err != nil {
+		if apierrors.IsNotFound(err) {
+			restore.SetFailed(fmt.Sprintf("backup %s not found", restore.Spec.Backup))
+		}
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	result, err := r.Imports.Ensure(restore, cluster, &backup)
+	if err != nil {
+		l.Error(err, "unable to start import", "backup", backup.Name)
+		return ctrl.Result{}, err
+	}
+	if result == nil {
+		// import manager notifies reconciler once import is finished
+		return ctrl.Result{}, nil
+	}
+	if result.Retry {
+		return ctrl.Result{}, result.Err
+	}
+	if result.Err != nil {
+		restore.SetFailed(fmt.Sprintf("unable to import backup %s: %v", backup.Name, result.Err))
+		r.Recorder.Eventf(cluster, corev1.EventTypeWarning, ReasonRestoreFailed, "Unable to import keys from backup %s: %v", backup.Name, result.Err)
+		return ctrl.Result{}, nil
+	}
+	stats := result.Stats
+
+	restore.Status.Phase = api.RestoreCompleted
+	restore.Status.Message = fmt.Sprintf("Imported %d keys and %d leases exported at revision %d", stats.Keys, stats.Leases, stats.Revision)
+	restore.Status.CompletionTime = metav1.Now()
+	r.Recorder.Eventf(cluster, corev1.EventTypeNormal, ReasonRestoreDone, "Imported %d keys from backup %s", stats.Keys, backup.Name)
+
+	return ctrl.Result{}, nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *RestoreReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&api.Restore{}).
+		Watches(&source.Channel{Source: r.Imports.Updates}, &handler.EnqueueRequestForObject{}).
+		Complete(r)
+}
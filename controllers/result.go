@@ -23,3 +23,20 @@ func Requeue() ctrl.Result {
 		Requeue: true,
 	}
 }
+
+// Earliest returns result which requeues reconciliation earlier
+func Earliest(results ...ctrl.Result) ctrl.Result {
+	var earliest ctrl.Result
+
+	for _, result := range results {
+		switch {
+		case result.Requeue:
+			return result
+		case result.RequeueAfter <= 0:
+		case earliest.RequeueAfter == 0 || result.RequeueAfter < earliest.RequeueAfter:
+			earliest = result
+		}
+	}
+
+	return earliest
+}
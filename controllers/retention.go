@@ -0,0 +1,97 @@
+/*
+Copyright 2022 Evgenii Omelchenko.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3.
+
+This program is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	api "github.com/elemir/etcdops/api/v1alpha1"
+)
+
+// SelectExpiredBackups returns backups of cluster which are not kept by
+// retention policy. Backups in progress and failed backups newer than the
+// newest succeeded one are always kept. Empty policy keeps all backups
+func SelectExpiredBackups(policy *api.RetentionPolicy, location *time.Location, backups []api.Backup) []api.Backup {
+	if policy.IsEmpty() {
+		return nil
+	}
+
+	var succeeded []api.Backup
+	for _, backup := range backups {
+		if backup.IsSucceeded() {
+			succeeded = append(succeeded, backup)
+		}
+	}
+
+	sort.Slice(succeeded, func(i, j int) bool {
+		return succeeded[i].Status.Finished.After(succeeded[j].Status.Finished.Time)
+	})
+
+	kept := make(map[string]bool)
+	if len(succeeded) > 0 {
+		kept[succeeded[0].Name] = true
+	}
+
+	for num := 0; num < policy.KeepLast && num < len(succeeded); num++ {
+		kept[succeeded[num].Name] = true
+	}
+
+	keepPeriods(kept, succeeded, policy.KeepDaily, func(t time.Time) string {
+		return t.In(location).Format("2006-01-02")
+	})
+	keepPeriods(kept, succeeded, policy.KeepWeekly, func(t time.Time) string {
+		year, week := t.In(location).ISOWeek()
+		return fmt.Sprintf("%d-%02d", year, week)
+	})
+	keepPeriods(kept, succeeded, policy.KeepMonthly, func(t time.Time) string {
+		return t.In(location).Format("2006-01")
+	})
+
+	var expired []api.Backup
+	for _, backup := range backups {
+		switch {
+		case kept[backup.Name]:
+		case backup.Spec.Imported:
+		case !backup.IsFinished():
+		case !backup.IsSucceeded() && (len(succeeded) == 0 || backup.CreationTimestamp.After(succeeded[0].CreationTimestamp.Time)):
+		default:
+			expired = append(expired, backup)
+		}
+	}
+
+	return expired
+}
+
+// keepPeriods keeps the newest backup of each of the latest count periods,
+// backups should be sorted from the newest to the oldest
+func keepPeriods(kept map[string]bool, backups []api.Backup, count int, period func(time.Time) string) {
+	last := ""
+	for _, backup := range backups {
+		if count <= 0 {
+			return
+		}
+
+		current := period(backup.Status.Finished.Time)
+		if current != last {
+			kept[backup.Name] = true
+			last = current
+			count--
+		}
+	}
+}
@@ -0,0 +1,151 @@
+/*
+Copyright 2022 Evgenii Omelchenko.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3.
+
+This program is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package controllers
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	api "github.com/elemir/etcdops/api/v1alpha1"
+)
+
+func retentionBackup(name string, phase api.BackupPhase, finished string) api.Backup {
+	backup := api.Backup{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+	}
+	backup.Status.Phase = phase
+	if finished != "" {
+		finishedTime, err := time.Parse(time.RFC3339, finished)
+		if err != nil {
+			panic(err)
+		}
+		backup.CreationTimestamp = metav1.NewTime(finishedTime.Add(-time.Minute))
+		backup.Status.Finished = metav1.NewTime(finishedTime)
+	}
+
+	return backup
+}
+
+func TestSelectExpiredBackups(t *testing.T) {
+	moscow := time.FixedZone("MSK", 3*60*60)
+
+	tests := []struct {
+		name     string
+		policy   api.RetentionPolicy
+		location *time.Location
+		backups  []api.Backup
+		expired  []string
+	}{
+		{
+			name:     "empty policy keeps everything",
+			location: time.UTC,
+			backups: []api.Backup{
+				retentionBackup("a", api.BackupSucceeded, "2022-03-01T10:00:00Z"),
+				retentionBackup("b", api.BackupSucceeded, "2022-03-02T10:00:00Z"),
+				retentionBackup("c", api.BackupFailed, "2022-03-01T12:00:00Z"),
+			},
+		},
+		{
+			name:     "keep last",
+			policy:   api.RetentionPolicy{KeepLast: 2},
+			location: time.UTC,
+			backups: []api.Backup{
+				retentionBackup("a", api.BackupSucceeded, "2022-03-01T10:00:00Z"),
+				retentionBackup("b", api.BackupSucceeded, "2022-03-02T10:00:00Z"),
+				retentionBackup("c", api.BackupSucceeded, "2022-03-03T10:00:00Z"),
+				retentionBackup("d", api.BackupSucceeded, "2022-03-04T10:00:00Z"),
+			},
+			expired: []string{"a", "b"},
+		},
+		{
+			name:     "failed backups",
+			policy:   api.RetentionPolicy{KeepLast: 1},
+			location: time.UTC,
+			backups: []api.Backup{
+				retentionBackup("old-failed", api.BackupFailed, "2022-03-01T10:00:00Z"),
+				retentionBackup("succeeded", api.BackupSucceeded, "2022-03-02T10:00:00Z"),
+				retentionBackup("new-failed", api.BackupFailed, "2022-03-03T10:00:00Z"),
+				retentionBackup("running", api.BackupRunning, ""),
+			},
+			expired: []string{"old-failed"},
+		},
+		{
+			name:     "only failed backups",
+			policy:   api.RetentionPolicy{KeepLast: 1},
+			location: time.UTC,
+			backups: []api.Backup{
+				retentionBackup("a", api.BackupFailed, "2022-03-01T10:00:00Z"),
+				retentionBackup("b", api.BackupFailed, "2022-03-02T10:00:00Z"),
+			},
+		},
+		{
+			name:     "daily in UTC",
+			policy:   api.RetentionPolicy{KeepDaily: 2},
+			location: time.UTC,
+			backups: []api.Backup{
+				retentionBackup("a", api.BackupSucceeded, "2022-03-01T22:00:00Z"),
+				retentionBackup("b", api.BackupSucceeded, "2022-03-01T23:30:00Z"),
+				retentionBackup("c", api.BackupSucceeded, "2022-03-02T00:30:00Z"),
+			},
+			expired: []string{"a"},
+		},
+		{
+			name:     "daily in time zone",
+			policy:   api.RetentionPolicy{KeepDaily: 2},
+			location: moscow,
+			backups: []api.Backup{
+				retentionBackup("a", api.BackupSucceeded, "2022-03-01T20:00:00Z"),
+				retentionBackup("b", api.BackupSucceeded, "2022-03-01T22:00:00Z"),
+				retentionBackup("c", api.BackupSucceeded, "2022-03-01T23:30:00Z"),
+				retentionBackup("d", api.BackupSucceeded, "2022-03-02T00:30:00Z"),
+			},
+			expired: []string{"b", "c"},
+		},
+		{
+			name:     "weekly and monthly",
+			policy:   api.RetentionPolicy{KeepWeekly: 2, KeepMonthly: 2},
+			location: time.UTC,
+			backups: []api.Backup{
+				retentionBackup("a", api.BackupSucceeded, "2022-01-20T10:00:00Z"),
+				retentionBackup("b", api.BackupSucceeded, "2022-02-20T10:00:00Z"),
+				retentionBackup("c", api.BackupSucceeded, "2022-02-22T10:00:00Z"),
+				retentionBackup("d", api.BackupSucceeded, "2022-02-28T10:00:00Z"),
+				retentionBackup("e", api.BackupSucceeded, "2022-03-01T10:00:00Z"),
+			},
+			expired: []string{"a", "b"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var expired []string
+			for _, backup := range SelectExpiredBackups(&test.policy, test.location, test.backups) {
+				expired = append(expired, backup.Name)
+			}
+			sort.Strings(expired)
+
+			if !reflect.DeepEqual(expired, test.expired) {
+				t.Errorf("expired backups are %v, expected %v", expired, test.expired)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2022 Evgenii Omelchenko.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3.
+
+This program is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"errors"
+	"sort"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	api "github.com/elemir/etcdops/api/v1alpha1"
+)
+
+// maxSnapshotLag is number of raft entries follower could lag behind leader
+// to be considered caught up
+const maxSnapshotLag = 1000
+
+// snapshotCandidate is healthy member snapshot could be taken from
+type snapshotCandidate struct {
+	member string
+	etcd   *clientv3.Client
+	status *clientv3.StatusResponse
+}
+
+func (c snapshotCandidate) isLeader() bool {
+	return c.status.Leader == c.status.Header.MemberId
+}
+
+// SelectSnapshotSource selects member to take snapshot from. Caught up
+// followers are preferred over leader by default, the least lagging one is
+// chosen among them. Lag is counted from raft index of leader, it is counted
+// from the most caught up member if leader is unreachable
+func SelectSnapshotSource(source api.SnapshotSource, candidates []snapshotCandidate) (*snapshotCandidate, error) {
+	if len(candidates) == 0 {
+		return nil, errors.New("no healthy members")
+	}
+
+	var leaderIndex uint64
+	leaderFound := false
+	for _, candidate := range candidates {
+		if candidate.isLeader() {
+			leaderIndex = candidate.status.RaftIndex
+			leaderFound = true
+		}
+	}
+	if !leaderFound {
+		for _, candidate := range candidates {
+			if candidate.status.RaftAppliedIndex > leaderIndex {
+				leaderIndex = candidate.status.RaftAppliedIndex
+			}
+		}
+	}
+
+	lag := func(candidate snapshotCandidate) uint64 {
+		if candidate.status.RaftAppliedIndex >= leaderIndex {
+			return 0
+		}
+		return leaderIndex - candidate.status.RaftAppliedIndex
+	}
+
+	var leader *snapshotCandidate
+	var followers []*snapshotCandidate
+	for i := range candidates {
+		switch {
+		case candidates[i].isLeader():
+			leader = &candidates[i]
+		case leaderIndex > 0 && lag(candidates[i]) <= maxSnapshotLag:
+			followers = append(followers, &candidates[i])
+		}
+	}
+	sort.SliceStable(followers, func(i, j int) bool {
+		return lag(*followers[i]) < lag(*followers[j])
+	})
+
+	switch source {
+	case api.SnapshotSourceLeader:
+		if leader == nil {
+			return nil, errors.New("leader is unavailable")
+		}
+		return leader, nil
+	case api.SnapshotSourceFollower:
+		if len(followers) == 0 {
+			return nil, errors.New("no caught up followers")
+		}
+		return followers[0], nil
+	case api.SnapshotSourceAny:
+		return &candidates[0], nil
+	}
+
+	if len(followers) > 0 {
+		return followers[0], nil
+	}
+	if leader != nil {
+		return leader, nil
+	}
+
+	return nil, errors.New("no caught up members")
+}
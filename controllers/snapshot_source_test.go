@@ -0,0 +1,134 @@
+/*
+Copyright 2022 Evgenii Omelchenko.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3.
+
+This program is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package controllers
+
+import (
+	"testing"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	api "github.com/elemir/etcdops/api/v1alpha1"
+)
+
+func sourceCandidate(member string, id, leader, index, applied uint64) snapshotCandidate {
+	return snapshotCandidate{
+		member: member,
+		status: &clientv3.StatusResponse{
+			Header: &etcdserverpb.ResponseHeader{
+				MemberId: id,
+			},
+			Leader:           leader,
+			RaftIndex:        index,
+			RaftAppliedIndex: applied,
+		},
+	}
+}
+
+func TestSelectSnapshotSource(t *testing.T) {
+	healthy := []snapshotCandidate{
+		sourceCandidate("leader", 1, 1, 5000, 5000),
+		sourceCandidate("lagging", 2, 1, 5000, 3000),
+		sourceCandidate("follower", 3, 1, 5000, 4990),
+	}
+	lagging := []snapshotCandidate{
+		sourceCandidate("lagging", 2, 1, 5000, 3000),
+		sourceCandidate("leader", 1, 1, 5000, 5000),
+	}
+	leaderless := []snapshotCandidate{
+		sourceCandidate("behind", 2, 1, 4000, 4000),
+		sourceCandidate("ahead", 3, 1, 4500, 4500),
+	}
+
+	tests := []struct {
+		name       string
+		source     api.SnapshotSource
+		candidates []snapshotCandidate
+		selected   string
+	}{
+		{
+			name: "no healthy members",
+		},
+		{
+			name:       "default prefers caught up follower",
+			candidates: healthy,
+			selected:   "follower",
+		},
+		{
+			name:       "default falls back to leader",
+			candidates: lagging,
+			selected:   "leader",
+		},
+		{
+			name:       "default without leader",
+			candidates: leaderless,
+			selected:   "ahead",
+		},
+		{
+			name:       "follower",
+			source:     api.SnapshotSourceFollower,
+			candidates: healthy,
+			selected:   "follower",
+		},
+		{
+			name:       "follower without caught up followers",
+			source:     api.SnapshotSourceFollower,
+			candidates: lagging,
+		},
+		{
+			name:       "follower without leader",
+			source:     api.SnapshotSourceFollower,
+			candidates: leaderless,
+			selected:   "ahead",
+		},
+		{
+			name:       "leader",
+			source:     api.SnapshotSourceLeader,
+			candidates: healthy,
+			selected:   "leader",
+		},
+		{
+			name:       "leader is unavailable",
+			source:     api.SnapshotSourceLeader,
+			candidates: leaderless,
+		},
+		{
+			name:       "any",
+			source:     api.SnapshotSourceAny,
+			candidates: lagging,
+			selected:   "lagging",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			source, err := SelectSnapshotSource(test.source, test.candidates)
+			if test.selected == "" {
+				if err == nil {
+					t.Errorf("member %s is selected, expected error", source.member)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unable to select member: %v", err)
+			}
+			if source.member != test.selected {
+				t.Errorf("member %s is selected, expected %s", source.member, test.selected)
+			}
+		})
+	}
+}
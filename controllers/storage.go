@@ -0,0 +1,326 @@
+/*
+Copyright 2022 Evgenii Omelchenko.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3.
+
+This program is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	api "github.com/elemir/etcdops/api/v1alpha1"
+	"github.com/elemir/etcdops/pkg/snapshot"
+	"github.com/elemir/etcdops/pkg/storage"
+)
+
+const (
+	encryptionKeyVolume = "encryption-key"
+	encryptionKeyPath   = "/var/lib/encryption"
+)
+
+// GetBackupStorage returns storage of backup snapshot, described either by
+// BackupStorageLocation or by operator configuration
+func GetBackupStorage(ctx context.Context, c client.Client, storages *storage.Registry, backup *api.Backup) (storage.BackupStorage, error) {
+	if backup.Spec.StorageLocation == "" {
+		return storages.Get(backup.Spec.Storage)
+	}
+
+	var location api.BackupStorageLocation
+	if err := c.Get(ctx, types.NamespacedName{
+		Name:      backup.Spec.StorageLocation,
+		Namespace: backup.Namespace,
+	}, &location); err != nil {
+		return nil, err
+	}
+
+	return GetLocationStorage(ctx, c, &location)
+}
+
+func GetLocationStorage(ctx context.Context, c client.Client, location *api.BackupStorageLocation) (*storage.S3Storage, error) {
+	config := getLocationConfig(location)
+
+	if location.Spec.CredentialsSecret != nil {
+		var secret corev1.Secret
+		if err := c.Get(ctx, types.NamespacedName{
+			Name:      location.Spec.CredentialsSecret.Name,
+			Namespace: location.Namespace,
+		}, &secret); err != nil {
+			return nil, err
+		}
+
+		config.Credentials = credentials.NewStaticCredentials(
+			string(secret.Data[api.AccessKeyIDSecretKey]),
+			string(secret.Data[api.SecretAccessKeySecretKey]),
+			string(secret.Data[api.SessionTokenSecretKey]),
+		)
+	}
+
+	return storage.NewS3Storage(config)
+}
+
+// GetFetchContainer returns init container which downloads backup snapshot
+// into member pod before restoration
+func GetFetchContainer(ctx context.Context, c client.Client, storages *storage.Registry, image string, member *api.Member) (*corev1.Container, []corev1.Volume, error) {
+	var backup api.Backup
+	if err := c.Get(ctx, types.NamespacedName{
+		Name:      member.Spec.Backup,
+		Namespace: member.Namespace,
+	}, &backup); err != nil {
+		return nil, nil, err
+	}
+	if !backup.IsSucceeded() {
+		return nil, nil, fmt.Errorf("backup %s is not succeeded", backup.Name)
+	}
+
+	return GetBackupFetchContainer(ctx, c, storages, image, &backup, member.GetSnapshotVolumeMount(), member.GetSnapshotPath())
+}
+
+// GetBackupFetchContainer returns container which downloads backup snapshot
+// into output file placed on given volume mount
+func GetBackupFetchContainer(ctx context.Context, c client.Client, storages *storage.Registry, image string, backup *api.Backup, mount corev1.VolumeMount, output string) (*corev1.Container, []corev1.Volume, error) {
+	if backup.GetType() != api.BackupTypeSnapshot {
+		return nil, nil, fmt.Errorf("backup %s is %s and couldn't be restored as snapshot", backup.Name, backup.GetType())
+	}
+
+	container := &corev1.Container{
+		Name:                     api.FetchContainerName,
+		Image:                    image,
+		Command:                  []string{"/fetcher"},
+		TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError,
+		VolumeMounts: []corev1.VolumeMount{
+			mount,
+		},
+	}
+
+	var config storage.S3Config
+	if backup.Spec.StorageLocation != "" {
+		var location api.BackupStorageLocation
+		if err := c.Get(ctx, types.NamespacedName{
+			Name:      backup.Spec.StorageLocation,
+			Namespace: backup.Namespace,
+		}, &location); err != nil {
+			return nil, nil, err
+		}
+
+		config = getLocationConfig(&location)
+		if location.Spec.CredentialsSecret != nil {
+			container.EnvFrom = []corev1.EnvFromSource{{
+				SecretRef: &corev1.SecretEnvSource{
+					LocalObjectReference: *location.Spec.CredentialsSecret,
+				},
+			}}
+		}
+	} else {
+		backupStorage, err := storages.Get(backup.Spec.Storage)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		s3Storage, ok := backupStorage.(*storage.S3Storage)
+		if !ok {
+			return nil, nil, fmt.Errorf("backup %s is placed in storage unreachable from member pods", backup.Name)
+		}
+		config = s3Storage.S3Config
+		if secret := storages.GetCredentialsSecret(backup.Spec.Storage); secret != "" {
+			container.EnvFrom = []corev1.EnvFromSource{{
+				SecretRef: &corev1.SecretEnvSource{
+					LocalObjectReference: corev1.LocalObjectReference{
+						Name: secret,
+					},
+				},
+			}}
+		}
+	}
+
+	container.Args = []string{
+		"--endpoint", config.Endpoint,
+		"--bucket", config.Bucket,
+		"--prefix", config.Prefix,
+		"--force-path-style=" + strconv.FormatBool(config.ForcePathStyle),
+		"--key", backup.GetStorageKey(),
+		"--compression", backup.GetCompression(),
+		"--checksum", backup.Status.Checksum,
+		"--output", output,
+	}
+	// fetcher falls back to region from its environment
+	if config.Region != "" {
+		container.Args = append(container.Args, "--region", config.Region)
+	}
+
+	var volumes []corev1.Volume
+	if keyID := backup.GetEncryptionKeyID(); keyID != "" {
+		if backup.Spec.Encryption == nil {
+			return nil, nil, fmt.Errorf("backup %s is encrypted but has no encryption key secret", backup.Name)
+		}
+
+		volumes = append(volumes, corev1.Volume{
+			Name: encryptionKeyVolume,
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{
+					SecretName: backup.Spec.Encryption.KeySecret,
+					Items: []corev1.KeyToPath{{
+						Key:  keyID,
+						Path: "key",
+					}},
+				},
+			},
+		})
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+			Name:      encryptionKeyVolume,
+			MountPath: encryptionKeyPath,
+			ReadOnly:  true,
+		})
+		container.Args = append(container.Args, "--encryption-key", path.Join(encryptionKeyPath, "key"))
+	}
+
+	return container, volumes, nil
+}
+
+// DeleteBackup removes backup snapshot from storage and then backup itself,
+// snapshot of backup with storage finalizer is removed by backup reconciler
+func DeleteBackup(ctx context.Context, c client.Client, storages *storage.Registry, backup *api.Backup) error {
+	if controllerutil.ContainsFinalizer(backup, api.StorageFinalizer) {
+		return client.IgnoreNotFound(c.Delete(ctx, backup))
+	}
+
+	backupStorage, err := GetBackupStorage(ctx, c, storages, backup)
+	if err != nil {
+		return err
+	}
+	if err := backupStorage.Delete(ctx, backup.GetStorageKey()); err != nil {
+		return err
+	}
+	if err := DeleteReplicas(ctx, c, backup); err != nil {
+		return err
+	}
+
+	return client.IgnoreNotFound(c.Delete(ctx, backup))
+}
+
+// IsNewestSucceeded returns true if backup is the newest succeeded backup of
+// its cluster
+func IsNewestSucceeded(ctx context.Context, c client.Client, backup *api.Backup) (bool, error) {
+	var backups api.BackupList
+	if err := c.List(ctx, &backups, client.InNamespace(backup.Namespace), client.MatchingLabels{
+		api.ClusterLabel: backup.Labels[api.ClusterLabel],
+	}); err != nil {
+		return false, err
+	}
+
+	for _, other := range backups.Items {
+		if other.Name != backup.Name && other.IsSucceeded() && other.Status.Finished.After(backup.Status.Finished.Time) {
+			return false, nil
+		}
+	}
+
+	return backup.IsSucceeded(), nil
+}
+
+// GetEncryptionKey returns backup encryption key with given ID from secret
+func GetEncryptionKey(ctx context.Context, c client.Client, namespace string, encryption *api.EncryptionSpec, keyID string) ([]byte, error) {
+	var secret corev1.Secret
+	if err := c.Get(ctx, types.NamespacedName{
+		Name:      encryption.KeySecret,
+		Namespace: namespace,
+	}, &secret); err != nil {
+		return nil, err
+	}
+
+	key, ok := secret.Data[keyID]
+	if !ok {
+		return nil, fmt.Errorf("secret %s has no encryption key %s", encryption.KeySecret, keyID)
+	}
+
+	return key, nil
+}
+
+// DecodeBackup decrypts and decompresses stored backup read from body, body
+// is closed with returned reader
+func DecodeBackup(ctx context.Context, c client.Client, backup *api.Backup, body io.ReadCloser) (io.ReadCloser, error) {
+	var decrypted io.Reader = body
+	if keyID := backup.GetEncryptionKeyID(); keyID != "" {
+		if backup.Spec.Encryption == nil {
+			body.Close()
+			return nil, fmt.Errorf("backup %s is encrypted but has no encryption key secret", backup.Name)
+		}
+
+		key, err := GetEncryptionKey(ctx, c, backup.Namespace, backup.Spec.Encryption, keyID)
+		if err != nil {
+			body.Close()
+			return nil, err
+		}
+
+		decrypted, err = snapshot.Decrypt(body, key)
+		if err != nil {
+			body.Close()
+			return nil, err
+		}
+	}
+
+	decompressed, err := snapshot.Decompress(decrypted, backup.GetCompression())
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+
+	return &backupReader{
+		ReadCloser: decompressed,
+		body:       body,
+	}, nil
+}
+
+// backupReader closes downloaded object after decoded backup is read
+type backupReader struct {
+	io.ReadCloser
+	body io.Closer
+}
+
+func (r *backupReader) Close() error {
+	err := r.ReadCloser.Close()
+	if closeErr := r.body.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+func getLocationConfig(location *api.BackupStorageLocation) storage.S3Config {
+	config := storage.S3Config{
+		Endpoint:             location.Spec.Endpoint,
+		Region:               location.Spec.Region,
+		Bucket:               location.Spec.Bucket,
+		Prefix:               location.Spec.Prefix,
+		ForcePathStyle:       location.Spec.ForcePathStyle,
+		StorageClass:         location.Spec.StorageClass,
+		ServerSideEncryption: location.Spec.ServerSideEncryption,
+		KMSKeyID:             location.Spec.KMSKeyID,
+		Tags:                 location.Spec.Tags,
+	}
+	if lock := location.Spec.ObjectLock; lock != nil {
+		config.ObjectLockMode = lock.Mode
+		config.ObjectLockRetention = lock.Retention
+	}
+
+	return config
+}
@@ -0,0 +1,274 @@
+/*
+Copyright 2022 Evgenii Omelchenko.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3.
+
+This program is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package controllers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	api "github.com/elemir/etcdops/api/v1alpha1"
+)
+
+// snapshotStatus is output of etcdctl snapshot status
+type snapshotStatus struct {
+	Hash     int64 `json:"hash"`
+	Revision int64 `json:"revision"`
+	TotalKey int   `json:"totalKey"`
+}
+
+// VerifyRestore runs job restoring backup snapshot into scratch directory and
+// sets Verified condition of backup by its result
+func (r *BackupReconciler) VerifyRestore(ctx context.Context, backup *api.Backup) (ctrl.Result, error) {
+	if backup.Status.VerificationJob != "" {
+		return r.CheckVerification(ctx, backup)
+	}
+	if !backup.ShouldVerifyRestore() {
+		if backup.Spec.VerifyRestore && backup.Spec.VerifyPeriod > 0 {
+			return ctrl.Result{
+				RequeueAfter: time.Until(backup.Status.LastVerificationTime.Add(backup.Spec.VerifyPeriod)),
+			}, nil
+		}
+		return ctrl.Result{}, nil
+	}
+
+	l := log.FromContext(ctx)
+
+	version, err := r.getEtcdVersion(ctx, backup)
+	if err != nil {
+		r.SetVerified(backup, false, "UnknownVersion", err.Error())
+		return ctrl.Result{}, nil
+	}
+
+	job := backup.GetVerificationJob(backup.GetVerificationJobName(time.Now()), version)
+	fetch, volumes, err := GetBackupFetchContainer(ctx, r.Client, r.Storages, r.FetcherImage, backup,
+		backup.GetVerificationSnapshotMount(), backup.GetVerificationSnapshotPath())
+	if err != nil {
+		r.SetVerified(backup, false, "FetchFailed", err.Error())
+		return ctrl.Result{}, nil
+	}
+	podSpec := &job.Spec.Template.Spec
+	podSpec.InitContainers = append([]corev1.Container{*fetch}, podSpec.InitContainers...)
+	podSpec.Volumes = append(podSpec.Volumes, volumes...)
+
+	if err := controllerutil.SetControllerReference(backup, job, r.Scheme); err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := r.Create(ctx, job); err != nil {
+		l.Error(err, "unable to create verification job")
+		return ctrl.Result{}, err
+	}
+
+	backup.Status.VerificationJob = job.Name
+	return ctrl.Result{}, nil
+}
+
+// CheckVerification sets result of finished verification job and removes it
+func (r *BackupReconciler) CheckVerification(ctx context.Context, backup *api.Backup) (ctrl.Result, error) {
+	var job batchv1.Job
+	if err := r.Get(ctx, types.NamespacedName{
+		Name:      backup.Status.VerificationJob,
+		Namespace: backup.Namespace,
+	}, &job); err != nil {
+		if errors.IsNotFound(err) {
+			backup.Status.VerificationJob = ""
+			return Requeue(), nil
+		}
+		return ctrl.Result{}, err
+	}
+
+	switch {
+	case job.Status.Succeeded > 0:
+		status, err := r.getSnapshotStatus(ctx, &job)
+		if err != nil {
+			r.SetVerified(backup, false, "StatusUnavailable", err.Error())
+			break
+		}
+
+		switch {
+		case backup.Status.Revision != 0 && status.Revision < backup.Status.Revision:
+			r.SetVerified(backup, false, "RevisionMismatch",
+				fmt.Sprintf("restored revision %d is older than recorded %d", status.Revision, backup.Status.Revision))
+		case backup.Status.SnapshotRevision != 0 && status.Revision != backup.Status.SnapshotRevision:
+			r.SetVerified(backup, false, "RevisionMismatch",
+				fmt.Sprintf("restored revision %d differs from recorded snapshot revision %d", status.Revision, backup.Status.SnapshotRevision))
+		case backup.Status.SnapshotHash != 0 && status.Hash != backup.Status.SnapshotHash:
+			r.SetVerified(backup, false, "HashMismatch",
+				fmt.Sprintf("restored snapshot hash %d differs from recorded %d", status.Hash, backup.Status.SnapshotHash))
+		default:
+			backup.Status.SnapshotHash = status.Hash
+			backup.Status.SnapshotRevision = status.Revision
+			r.SetVerified(backup, true, "Restored",
+				fmt.Sprintf("Restored snapshot with %d keys at revision %d", status.TotalKey, status.Revision))
+		}
+	case isJobDeadlineExceeded(&job):
+		r.SetVerified(backup, false, "DeadlineExceeded",
+			fmt.Sprintf("verification job did not finish in %s", api.VerificationDeadline))
+	case job.Status.Failed > 0:
+		r.SetVerified(backup, false, "RestoreFailed", r.getFailureMessage(ctx, &job))
+	default:
+		return ctrl.Result{}, nil
+	}
+
+	backup.Status.VerificationJob = ""
+	backup.Status.LastVerificationTime = metav1.Now()
+
+	propagation := metav1.DeletePropagationBackground
+	if err := r.Delete(ctx, &job, &client.DeleteOptions{
+		PropagationPolicy: &propagation,
+	}); client.IgnoreNotFound(err) != nil {
+		return ctrl.Result{}, err
+	}
+
+	if backup.Spec.VerifyPeriod > 0 {
+		return ctrl.Result{
+			RequeueAfter: backup.Spec.VerifyPeriod,
+		}, nil
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// SetVerified sets Verified condition of backup and reports verification
+func (r *BackupReconciler) SetVerified(backup *api.Backup, verified bool, reason, message string) {
+	condition := metav1.Condition{
+		Type:               api.BackupVerified,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: backup.Generation,
+		Reason:             reason,
+		Message:            message,
+	}
+	result := "succeeded"
+	eventType := corev1.EventTypeNormal
+	eventReason := ReasonBackupVerified
+	if !verified {
+		condition.Status = metav1.ConditionFalse
+		result = "failed"
+		eventType = corev1.EventTypeWarning
+		eventReason = ReasonBackupCorrupted
+	}
+
+	meta.SetStatusCondition(&backup.Status.Conditions, condition)
+	backupVerifications.WithLabelValues(backup.Namespace, backup.Labels[api.ClusterLabel], result).Inc()
+	r.Recorder.Eventf(backup, eventType, eventReason, "Restore verification %s: %s", result, message)
+}
+
+func (r *BackupReconciler) getEtcdVersion(ctx context.Context, backup *api.Backup) (string, error) {
+	if backup.Status.EtcdVersion != "" {
+		return backup.Status.EtcdVersion, nil
+	}
+
+	var cluster api.Cluster
+	if err := r.Get(ctx, types.NamespacedName{
+		Name:      backup.Labels[api.ClusterLabel],
+		Namespace: backup.Namespace,
+	}, &cluster); err != nil {
+		return "", fmt.Errorf("unable to find etcd version of backup: %w", err)
+	}
+
+	return cluster.Spec.Version, nil
+}
+
+func (r *BackupReconciler) getJobPod(ctx context.Context, job *batchv1.Job) (*corev1.Pod, error) {
+	var pods corev1.PodList
+	if err := r.List(ctx, &pods, client.InNamespace(job.Namespace), client.MatchingLabels{
+		"job-name": job.Name,
+	}); err != nil {
+		return nil, err
+	}
+	if len(pods.Items) == 0 {
+		return nil, fmt.Errorf("pod of job %s not found", job.Name)
+	}
+
+	return &pods.Items[0], nil
+}
+
+// getSnapshotStatus parses snapshot status printed by verification job
+func (r *BackupReconciler) getSnapshotStatus(ctx context.Context, job *batchv1.Job) (*snapshotStatus, error) {
+	pod, err := r.getJobPod(ctx, job)
+	if err != nil {
+		return nil, err
+	}
+
+	logs, err := r.Clientset.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &corev1.PodLogOptions{
+		Container: api.VerifyContainerName,
+	}).DoRaw(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// etcdctl could print deprecation warnings before status
+	scanner := bufio.NewScanner(strings.NewReader(string(logs)))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "{") {
+			continue
+		}
+
+		var status snapshotStatus
+		if err := json.Unmarshal([]byte(line), &status); err != nil {
+			return nil, err
+		}
+		return &status, nil
+	}
+
+	return nil, fmt.Errorf("snapshot status is not found in output of job %s", job.Name)
+}
+
+// isJobDeadlineExceeded returns true if job is failed by active deadline,
+// its pods are killed then, so they could have no failed containers
+func isJobDeadlineExceeded(job *batchv1.Job) bool {
+	for _, condition := range job.Status.Conditions {
+		if condition.Type == batchv1.JobFailed && condition.Status == corev1.ConditionTrue &&
+			condition.Reason == "DeadlineExceeded" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getFailureMessage returns termination message of failed container of job
+func (r *BackupReconciler) getFailureMessage(ctx context.Context, job *batchv1.Job) string {
+	pod, err := r.getJobPod(ctx, job)
+	if err != nil {
+		return err.Error()
+	}
+
+	statuses := append(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses...)
+	for _, status := range statuses {
+		if terminated := status.State.Terminated; terminated != nil && terminated.ExitCode != 0 {
+			return fmt.Sprintf("container %s failed: %s", status.Name, strings.TrimSpace(terminated.Message))
+		}
+	}
+
+	return "verification job failed"
+}
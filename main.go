@@ -19,11 +19,7 @@ package main
 import (
 	"flag"
 	"os"
-
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"time"
 
 	certv1 "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
 
@@ -33,14 +29,17 @@ import (
 
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/kubernetes"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	api "github.com/elemir/etcdops/api/v1alpha1"
 	operatorv1alpha1 "github.com/elemir/etcdops/api/v1alpha1"
 	"github.com/elemir/etcdops/controllers"
+	"github.com/elemir/etcdops/pkg/storage"
 	//+kubebuilder:scaffold:imports
 )
 
@@ -67,10 +66,40 @@ func main() {
 	var s3bucket string
 	var s3prefix string
 	var s3endpoint string
+	var s3region string
+	var s3storageClass string
+	var s3sse string
+	var s3kmsKeyID string
+	var s3lockMode string
+	var s3lockRetention time.Duration
+	var s3credentialsSecret string
+	var backupDir string
+	var defaultStorage string
+	var fetcherImage string
+	var deleteOrphans bool
+	var importNamespace string
 
 	flag.StringVar(&s3prefix, "s3-prefix", "", "Folder in S3 for backup uploads.")
 	flag.StringVar(&s3bucket, "s3-bucket", "", "Bucket in S3 for backup uploads.")
 	flag.StringVar(&s3endpoint, "s3-endpoint", "", "Override default amazon S3 URL.")
+	flag.StringVar(&s3region, "s3-region", "", "Region of S3 bucket, AWS_REGION is used if it is not set.")
+	flag.StringVar(&s3storageClass, "s3-storage-class", "", "Storage class of backups uploaded to S3.")
+	flag.StringVar(&s3sse, "s3-server-side-encryption", "", "Server-side encryption of backups uploaded to S3: AES256 or aws:kms.")
+	flag.StringVar(&s3kmsKeyID, "s3-kms-key-id", "", "KMS key used by aws:kms server-side encryption.")
+	flag.StringVar(&s3lockMode, "s3-object-lock-mode", "", "Object Lock mode of backups uploaded to S3: GOVERNANCE or COMPLIANCE.")
+	flag.DurationVar(&s3lockRetention, "s3-object-lock-retention", 0,
+		"Object Lock duration of backups uploaded to S3 without retention period.")
+	flag.StringVar(&backupDir, "backup-dir", "", "Directory for backup uploads to filesystem storage.")
+	flag.StringVar(&s3credentialsSecret, "s3-credentials-secret", "",
+		"Secret with AWS credentials passed to pods fetching backups from S3, it is looked up in namespace of cluster.")
+	flag.StringVar(&defaultStorage, "default-backup-storage", api.BackupStorageS3,
+		"Backup storage used for clusters without explicitly specified one: s3 or filesystem.")
+	flag.StringVar(&fetcherImage, "fetcher-image", "cr.yandex/crpj9v5sqvlclb1os12m/etcdops:latest",
+		"Image with etcdops-fetcher used for downloading backups into member pods.")
+	flag.BoolVar(&deleteOrphans, "delete-orphaned-backups", false,
+		"Remove snapshots without matching backups from backup storages, snapshots retained on backup deletion are kept.")
+	flag.StringVar(&importNamespace, "import-backups-namespace", "",
+		"Namespace where snapshots without matching backups are imported as backups instead of being removed.")
 
 	flag.StringVar(&clusterIssuer, "cluster-issuer", "", "ClusterIssuer resource for generating cluster SA.")
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
@@ -99,16 +128,43 @@ func main() {
 		os.Exit(1)
 	}
 
-	s3sess, err := session.NewSession(&aws.Config{
-		Endpoint: &s3endpoint,
-	})
-	if err != nil {
-		setupLog.Error(err, "unable to establish S3 connection from standard configs")
+	storages := &storage.Registry{
+		Default:  defaultStorage,
+		Storages: map[string]storage.BackupStorage{},
+		CredentialsSecrets: map[string]string{
+			api.BackupStorageS3: s3credentialsSecret,
+		},
+	}
+	if s3bucket != "" {
+		s3storage, err := storage.NewS3Storage(storage.S3Config{
+			Endpoint:             s3endpoint,
+			Region:               s3region,
+			Bucket:               s3bucket,
+			Prefix:               s3prefix,
+			StorageClass:         s3storageClass,
+			ServerSideEncryption: s3sse,
+			KMSKeyID:             s3kmsKeyID,
+			ObjectLockMode:       s3lockMode,
+			ObjectLockRetention:  s3lockRetention,
+		})
+		if err != nil {
+			setupLog.Error(err, "unable to establish S3 connection from standard configs")
+		} else {
+			storages.Storages[api.BackupStorageS3] = s3storage
+		}
+	}
+	if backupDir != "" {
+		storages.Storages[api.BackupStorageFilesystem] = &storage.FileStorage{
+			Root: backupDir,
+		}
 	}
 
 	if err = (&controllers.MemberReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:       mgr.GetClient(),
+		Scheme:       mgr.GetScheme(),
+		Recorder:     mgr.GetEventRecorderFor("member-controller"),
+		Storages:     storages,
+		FetcherImage: fetcherImage,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Member")
 		os.Exit(1)
@@ -116,29 +172,79 @@ func main() {
 	if err = (&controllers.ClusterReconciler{
 		Client:        mgr.GetClient(),
 		Scheme:        mgr.GetScheme(),
+		Recorder:      mgr.GetEventRecorderFor("cluster-controller"),
+		Storages:      storages,
 		ClusterIssuer: clusterIssuer,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Cluster")
 		os.Exit(1)
 	}
 	if err = (&controllers.BackupReconciler{
-		Client:     mgr.GetClient(),
-		Scheme:     mgr.GetScheme(),
-		S3Uploader: s3manager.NewUploader(s3sess),
-		S3API:      s3.New(s3sess),
-		S3Bucket:   s3bucket,
-		S3Prefix:   s3prefix,
+		Client:       mgr.GetClient(),
+		Scheme:       mgr.GetScheme(),
+		Recorder:     mgr.GetEventRecorderFor("backup-controller"),
+		Storages:     storages,
+		Clientset:    kubernetes.NewForConfigOrDie(mgr.GetConfig()),
+		FetcherImage: fetcherImage,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Backup")
 		os.Exit(1)
 	}
+	journals := &controllers.JournalManager{
+		Client:   mgr.GetClient(),
+		Storages: storages,
+		Updates:  make(chan event.GenericEvent),
+	}
+	if err = mgr.Add(journals); err != nil {
+		setupLog.Error(err, "unable to add journal manager")
+		os.Exit(1)
+	}
 	if err = (&controllers.BackupScheduleReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("backupschedule-controller"),
+		Storages: storages,
+		Journals: journals,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "BackupSchedule")
 		os.Exit(1)
 	}
+	if err = (&controllers.BackupStorageLocationReconciler{
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Storages: storages,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "BackupStorageLocation")
+		os.Exit(1)
+	}
+	imports := &controllers.ImportManager{
+		Client:   mgr.GetClient(),
+		Storages: storages,
+		Updates:  make(chan event.GenericEvent),
+	}
+	if err = mgr.Add(imports); err != nil {
+		setupLog.Error(err, "unable to add import manager")
+		os.Exit(1)
+	}
+	if err = (&controllers.RestoreReconciler{
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("restore-controller"),
+		Storages: storages,
+		Imports:  imports,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "Restore")
+		os.Exit(1)
+	}
+	if err = mgr.Add(&controllers.OrphanCollector{
+		Client:          mgr.GetClient(),
+		Storages:        storages,
+		Delete:          deleteOrphans,
+		ImportNamespace: importNamespace,
+	}); err != nil {
+		setupLog.Error(err, "unable to add orphaned snapshots collector")
+		os.Exit(1)
+	}
 	if err = (&operatorv1alpha1.Cluster{}).SetupWebhookWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create webhook", "webhook", "Cluster")
 		os.Exit(1)
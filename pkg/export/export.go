@@ -0,0 +1,205 @@
+/*
+Copyright 2022 Evgenii Omelchenko.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3.
+
+This program is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package export implements portable logical backups of etcd keyspace. An
+// export is a stream of JSON lines, the first line is a header followed by
+// lease records and then by key records
+package export
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"sort"
+	"strings"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	// Format identifies export streams
+	Format = "etcdops-export"
+	// Version is the latest version of export format
+	Version = 1
+
+	pageSize = 1000
+)
+
+// Client is part of etcd client keys and leases are exported from and
+// imported into
+type Client interface {
+	clientv3.KV
+	clientv3.Lease
+}
+
+// IsExport returns true if data starts with export header
+func IsExport(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(`{"format":"`+Format+`"`))
+}
+
+// Header is the first record of export
+type Header struct {
+	Format   string   `json:"format"`
+	Version  int      `json:"version"`
+	Revision int64    `json:"revision"`
+	Prefixes []string `json:"prefixes,omitempty"`
+}
+
+// Record is either lease or key record of export
+type Record struct {
+	Type RecordType `json:"type"`
+
+	// Lease and key records
+	Lease int64 `json:"lease,omitempty"`
+	// Lease records
+	TTL int64 `json:"ttl,omitempty"`
+
+	// Key records
+	Key            []byte `json:"key,omitempty"`
+	Value          []byte `json:"value,omitempty"`
+	CreateRevision int64  `json:"createRevision,omitempty"`
+	ModRevision    int64  `json:"modRevision,omitempty"`
+	Version        int64  `json:"version,omitempty"`
+}
+
+type RecordType string
+
+const (
+	RecordLease RecordType = "lease"
+	RecordKey   RecordType = "key"
+)
+
+// Export returns reader of keys placed under prefixes at revision. Whole
+// keyspace is exported if no prefixes are given, overlapping prefixes export
+// their keys once
+func Export(ctx context.Context, etcd Client, revision int64, prefixes []string) io.ReadCloser {
+	pr, pw := io.Pipe()
+
+	go func() {
+		pw.CloseWithError(write(ctx, etcd, revision, normalizePrefixes(prefixes), pw))
+	}()
+
+	return pr
+}
+
+// normalizePrefixes sorts prefixes and drops the ones covered by others, nil
+// is returned if any prefix covers the whole keyspace
+func normalizePrefixes(prefixes []string) []string {
+	sorted := append([]string(nil), prefixes...)
+	sort.Strings(sorted)
+
+	var normalized []string
+	for _, prefix := range sorted {
+		// prefix is covered by the previous one if any prefix covers it
+		if len(normalized) > 0 && strings.HasPrefix(prefix, normalized[len(normalized)-1]) {
+			continue
+		}
+		normalized = append(normalized, prefix)
+	}
+
+	if len(normalized) > 0 && normalized[0] == "" {
+		return nil
+	}
+
+	return normalized
+}
+
+func write(ctx context.Context, etcd Client, revision int64, prefixes []string, w io.Writer) error {
+	encoder := json.NewEncoder(w)
+
+	if err := encoder.Encode(Header{
+		Format:   Format,
+		Version:  Version,
+		Revision: revision,
+		Prefixes: prefixes,
+	}); err != nil {
+		return err
+	}
+
+	leases, err := etcd.Leases(ctx)
+	if err != nil {
+		return err
+	}
+	for _, lease := range leases.Leases {
+		ttl, err := etcd.TimeToLive(ctx, lease.ID)
+		if err != nil {
+			return err
+		}
+		if ttl.TTL <= 0 {
+			continue
+		}
+
+		if err := encoder.Encode(Record{
+			Type:  RecordLease,
+			Lease: int64(lease.ID),
+			TTL:   ttl.TTL,
+		}); err != nil {
+			return err
+		}
+	}
+
+	if len(prefixes) == 0 {
+		prefixes = []string{""}
+	}
+
+	for _, prefix := range prefixes {
+		if err := writePrefix(ctx, etcd, revision, prefix, encoder); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writePrefix(ctx context.Context, etcd Client, revision int64, prefix string, encoder *json.Encoder) error {
+	end := clientv3.GetPrefixRangeEnd(prefix)
+	if prefix == "" {
+		prefix = "\x00"
+		end = "\x00"
+	}
+
+	key := prefix
+	for {
+		resp, err := etcd.Get(ctx, key,
+			clientv3.WithRange(end),
+			clientv3.WithRev(revision),
+			clientv3.WithLimit(pageSize),
+			clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+		if err != nil {
+			return err
+		}
+
+		for _, kv := range resp.Kvs {
+			if err := encoder.Encode(Record{
+				Type:           RecordKey,
+				Key:            kv.Key,
+				Value:          kv.Value,
+				Lease:          kv.Lease,
+				CreateRevision: kv.CreateRevision,
+				ModRevision:    kv.ModRevision,
+				Version:        kv.Version,
+			}); err != nil {
+				return err
+			}
+		}
+
+		if !resp.More || len(resp.Kvs) == 0 {
+			return nil
+		}
+		key = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00"
+	}
+}
@@ -0,0 +1,301 @@
+/*
+Copyright 2022 Evgenii Omelchenko.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3.
+
+This program is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package export
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc"
+)
+
+// fakeEtcd keeps keys and leases in memory, KV requests are served through
+// real KV client on top of fake gRPC one
+type fakeEtcd struct {
+	clientv3.KV
+	clientv3.Lease
+
+	revision  int64
+	kvs       map[string]*mvccpb.KeyValue
+	leases    map[clientv3.LeaseID]int64
+	nextLease clientv3.LeaseID
+}
+
+func newFakeEtcd() *fakeEtcd {
+	etcd := &fakeEtcd{
+		kvs:       make(map[string]*mvccpb.KeyValue),
+		leases:    make(map[clientv3.LeaseID]int64),
+		nextLease: 100,
+	}
+	etcd.KV = clientv3.NewKVFromKVClient(&fakeKV{etcd: etcd}, nil)
+
+	return etcd
+}
+
+func (e *fakeEtcd) Grant(ctx context.Context, ttl int64) (*clientv3.LeaseGrantResponse, error) {
+	e.nextLease++
+	e.leases[e.nextLease] = ttl
+
+	return &clientv3.LeaseGrantResponse{ID: e.nextLease, TTL: ttl}, nil
+}
+
+func (e *fakeEtcd) Leases(ctx context.Context) (*clientv3.LeaseLeasesResponse, error) {
+	var resp clientv3.LeaseLeasesResponse
+	for id := range e.leases {
+		resp.Leases = append(resp.Leases, clientv3.LeaseStatus{ID: id})
+	}
+
+	return &resp, nil
+}
+
+func (e *fakeEtcd) TimeToLive(ctx context.Context, id clientv3.LeaseID, opts ...clientv3.LeaseOption) (*clientv3.LeaseTimeToLiveResponse, error) {
+	ttl, ok := e.leases[id]
+	if !ok {
+		ttl = -1
+	}
+
+	return &clientv3.LeaseTimeToLiveResponse{ID: id, TTL: ttl}, nil
+}
+
+func (e *fakeEtcd) put(key, value string, lease clientv3.LeaseID) {
+	e.revision++
+	kv, ok := e.kvs[key]
+	if !ok {
+		kv = &mvccpb.KeyValue{
+			Key:            []byte(key),
+			CreateRevision: e.revision,
+		}
+		e.kvs[key] = kv
+	}
+	kv.Value = []byte(value)
+	kv.Lease = int64(lease)
+	kv.ModRevision = e.revision
+	kv.Version++
+}
+
+// values returns values of keys with TTL of their leases
+func (e *fakeEtcd) values() map[string]string {
+	values := make(map[string]string)
+	for key, kv := range e.kvs {
+		value := string(kv.Value)
+		if kv.Lease != 0 {
+			value = fmt.Sprintf("%s ttl=%d", value, e.leases[clientv3.LeaseID(kv.Lease)])
+		}
+		values[key] = value
+	}
+
+	return values
+}
+
+type fakeKV struct {
+	pb.KVClient
+	etcd *fakeEtcd
+}
+
+func (f *fakeKV) Range(ctx context.Context, req *pb.RangeRequest, opts ...grpc.CallOption) (*pb.RangeResponse, error) {
+	var keys []string
+	for key := range f.etcd.kvs {
+		switch {
+		case key < string(req.Key):
+		case string(req.RangeEnd) == "\x00":
+			keys = append(keys, key)
+		case len(req.RangeEnd) == 0 && key != string(req.Key):
+		case len(req.RangeEnd) > 0 && key >= string(req.RangeEnd):
+		default:
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	resp := &pb.RangeResponse{
+		Header: &pb.ResponseHeader{Revision: f.etcd.revision},
+		Count:  int64(len(keys)),
+	}
+	if req.Limit > 0 && int64(len(keys)) > req.Limit {
+		keys = keys[:req.Limit]
+		resp.More = true
+	}
+	for _, key := range keys {
+		kv := *f.etcd.kvs[key]
+		resp.Kvs = append(resp.Kvs, &kv)
+	}
+
+	return resp, nil
+}
+
+func (f *fakeKV) Put(ctx context.Context, req *pb.PutRequest, opts ...grpc.CallOption) (*pb.PutResponse, error) {
+	f.etcd.put(string(req.Key), string(req.Value), clientv3.LeaseID(req.Lease))
+
+	return &pb.PutResponse{
+		Header: &pb.ResponseHeader{Revision: f.etcd.revision},
+	}, nil
+}
+
+func exportHeader(t *testing.T, data string) Header {
+	line, _, err := bufio.NewReader(strings.NewReader(data)).ReadLine()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var header Header
+	if err := json.Unmarshal(line, &header); err != nil {
+		t.Fatal(err)
+	}
+
+	return header
+}
+
+func TestRoundTrip(t *testing.T) {
+	source := newFakeEtcd()
+	lease, _ := source.Grant(context.Background(), 60)
+	source.put("a/1", "one", 0)
+	source.put("a/2", "two", 0)
+	source.put("b/1", "leased", lease.ID)
+	source.put("b/2", "expired", 42)
+	source.put("c/1", "other", 0)
+	for i := 0; i < 2*pageSize+1; i++ {
+		source.put(fmt.Sprintf("d/%04d", i), "paged", 0)
+	}
+
+	for _, tc := range []struct {
+		name           string
+		exportPrefixes []string
+		importPrefixes []string
+		header         []string
+		keys           []string
+		paged          bool
+		leases         int
+	}{{
+		name:   "whole keyspace",
+		keys:   []string{"a/1", "a/2", "b/1", "c/1"},
+		paged:  true,
+		leases: 1,
+	}, {
+		name:           "overlapping prefixes",
+		exportPrefixes: []string{"b/", "a/1", "a/"},
+		header:         []string{"a/", "b/"},
+		keys:           []string{"a/1", "a/2", "b/1"},
+		leases:         1,
+	}, {
+		name:           "empty prefix",
+		exportPrefixes: []string{"a/", ""},
+		keys:           []string{"a/1", "a/2", "b/1", "c/1"},
+		paged:          true,
+		leases:         1,
+	}, {
+		name:           "import prefixes",
+		importPrefixes: []string{"a/", "c/"},
+		keys:           []string{"a/1", "a/2", "c/1"},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			data, err := io.ReadAll(Export(context.Background(), source, source.revision, tc.exportPrefixes))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if header := exportHeader(t, string(data)); !reflect.DeepEqual(header.Prefixes, tc.header) {
+				t.Errorf("header prefixes = %v, want %v", header.Prefixes, tc.header)
+			}
+
+			target := newFakeEtcd()
+			target.put("z/1", "kept", 0)
+			stats, err := Import(context.Background(), target, strings.NewReader(string(data)), tc.importPrefixes)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := map[string]string{
+				"z/1": "kept",
+			}
+			// keys of expired leases are skipped, the live lease is granted
+			// again with its TTL
+			for _, key := range tc.keys {
+				want[key] = string(source.kvs[key].Value)
+			}
+			if _, ok := want["b/1"]; ok {
+				want["b/1"] = "leased ttl=60"
+			}
+			if tc.paged {
+				for i := 0; i < 2*pageSize+1; i++ {
+					want[fmt.Sprintf("d/%04d", i)] = "paged"
+				}
+			}
+
+			if got := target.values(); !reflect.DeepEqual(got, want) {
+				t.Errorf("imported %d keys, want %d", len(got), len(want))
+				for key, value := range want {
+					if got[key] != value {
+						t.Errorf("key %s = %q, want %q", key, got[key], value)
+					}
+				}
+			}
+			if stats.Keys != len(want)-1 || stats.Leases != tc.leases || stats.Revision != source.revision {
+				t.Errorf("stats = %+v, want %d keys, %d leases at revision %d", stats, len(want)-1, tc.leases, source.revision)
+			}
+		})
+	}
+}
+
+func TestImportInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		data string
+	}{{
+		name: "empty",
+	}, {
+		name: "unknown format",
+		data: `{"format":"other","version":1}`,
+	}, {
+		name: "newer version",
+		data: fmt.Sprintf(`{"format":"%s","version":%d}`, Format, Version+1),
+	}, {
+		name: "invalid record",
+		data: fmt.Sprintf("{\"format\":\"%s\",\"version\":%d}\n{", Format, Version),
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := Import(context.Background(), newFakeEtcd(), strings.NewReader(tc.data), nil); err == nil {
+				t.Error("invalid export is imported")
+			}
+		})
+	}
+}
+
+func TestNormalizePrefixes(t *testing.T) {
+	for _, tc := range []struct {
+		prefixes []string
+		want     []string
+	}{
+		{prefixes: nil, want: nil},
+		{prefixes: []string{"b/", "a/"}, want: []string{"a/", "b/"}},
+		{prefixes: []string{"a/b/", "a/", "a/"}, want: []string{"a/"}},
+		{prefixes: []string{"a", "ab", "b/c", "b/"}, want: []string{"a", "b/"}},
+		{prefixes: []string{"a/", ""}, want: nil},
+	} {
+		if got := normalizePrefixes(tc.prefixes); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("normalizePrefixes(%v) = %v, want %v", tc.prefixes, got, tc.want)
+		}
+	}
+}
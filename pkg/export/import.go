@@ -0,0 +1,129 @@
+/*
+Copyright 2022 Evgenii Omelchenko.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3.
+
+This program is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package export
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// maxRecordSize limits size of single record line
+const maxRecordSize = 64 * 1024 * 1024
+
+// Stats describes imported export
+type Stats struct {
+	Revision int64
+	Keys     int
+	Leases   int
+}
+
+// Import puts keys of export placed under prefixes into cluster, whole export
+// is imported if no prefixes are given. Leases are granted again with their
+// remaining TTL, existing keys are overwritten and other keys are kept
+func Import(ctx context.Context, etcd Client, r io.Reader, prefixes []string) (*Stats, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxRecordSize)
+
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("export is empty")
+	}
+
+	var header Header
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		return nil, fmt.Errorf("invalid export header: %w", err)
+	}
+	if header.Format != Format {
+		return nil, fmt.Errorf("unknown export format %q", header.Format)
+	}
+	if header.Version > Version {
+		return nil, fmt.Errorf("unsupported export version %d", header.Version)
+	}
+
+	stats := &Stats{
+		Revision: header.Revision,
+	}
+	ttls := make(map[int64]int64)
+	leases := make(map[int64]clientv3.LeaseID)
+
+	for scanner.Scan() {
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("invalid export record: %w", err)
+		}
+
+		switch record.Type {
+		case RecordLease:
+			ttls[record.Lease] = record.TTL
+		case RecordKey:
+			if !matchPrefixes(string(record.Key), prefixes) {
+				continue
+			}
+
+			var opts []clientv3.OpOption
+			if record.Lease != 0 {
+				lease, ok := leases[record.Lease]
+				if !ok {
+					ttl, ok := ttls[record.Lease]
+					if !ok {
+						// lease is expired before export
+						continue
+					}
+
+					// leases are granted once they are used by imported keys
+					grant, err := etcd.Grant(ctx, ttl)
+					if err != nil {
+						return nil, err
+					}
+					lease = grant.ID
+					leases[record.Lease] = lease
+					stats.Leases++
+				}
+				opts = append(opts, clientv3.WithLease(lease))
+			}
+
+			if _, err := etcd.Put(ctx, string(record.Key), string(record.Value), opts...); err != nil {
+				return nil, err
+			}
+			stats.Keys++
+		}
+	}
+
+	return stats, scanner.Err()
+}
+
+func matchPrefixes(key string, prefixes []string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
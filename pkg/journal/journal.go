@@ -0,0 +1,111 @@
+/*
+Copyright 2022 Evgenii Omelchenko.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3.
+
+This program is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package journal implements continuous journal of etcd changes used for
+// point-in-time recovery. Journal is stored as segments, every segment is a
+// stream of JSON lines with events of consecutive revisions. Segments are
+// grouped by history of cluster, since revisions are reused after cluster is
+// restored
+package journal
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Prefix is a folder of journal segments inside cluster folder of storage
+const Prefix = "journal"
+
+// Event is a single change of key
+type Event struct {
+	Type     EventType `json:"type"`
+	Key      []byte    `json:"key"`
+	Value    []byte    `json:"value,omitempty"`
+	Lease    int64     `json:"lease,omitempty"`
+	Revision int64     `json:"revision"`
+	// Time is time event is received by operator, it approximates time of
+	// change
+	Time time.Time `json:"time"`
+}
+
+type EventType string
+
+const (
+	EventPut    EventType = "put"
+	EventDelete EventType = "delete"
+)
+
+// Segment is a stored part of journal with events of revisions from First
+// to Last
+type Segment struct {
+	Key     string
+	History string
+	First   int64
+	Last    int64
+	// KeyID is ID of key segment is encrypted with
+	KeyID string
+}
+
+// ClusterPrefix returns storage prefix of cluster journal segments
+func ClusterPrefix(cluster string) string {
+	return path.Join(cluster, Prefix) + "/"
+}
+
+// HistoryPrefix returns storage prefix of journal segments of single cluster
+// history
+func HistoryPrefix(cluster, history string) string {
+	return ClusterPrefix(cluster) + history + "/"
+}
+
+// SegmentKey returns storage key of segment, ID of encryption key is a part
+// of segment key since segments have no other metadata
+func SegmentKey(cluster, history string, first, last int64, keyID string) string {
+	name := fmt.Sprintf("%020d-%020d", first, last)
+	if keyID != "" {
+		name += "@" + keyID
+	}
+
+	return HistoryPrefix(cluster, history) + name
+}
+
+// ParseSegmentKey parses storage key of segment
+func ParseSegmentKey(key string) (Segment, bool) {
+	name, keyID, _ := strings.Cut(path.Base(key), "@")
+
+	firstStr, lastStr, ok := strings.Cut(name, "-")
+	if !ok {
+		return Segment{}, false
+	}
+	first, err := strconv.ParseInt(firstStr, 10, 64)
+	if err != nil {
+		return Segment{}, false
+	}
+	last, err := strconv.ParseInt(lastStr, 10, 64)
+	if err != nil || last < first {
+		return Segment{}, false
+	}
+
+	return Segment{
+		Key:     key,
+		History: path.Base(path.Dir(key)),
+		First:   first,
+		Last:    last,
+		KeyID:   keyID,
+	}, true
+}
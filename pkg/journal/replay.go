@@ -0,0 +1,139 @@
+/*
+Copyright 2022 Evgenii Omelchenko.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3.
+
+This program is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package journal
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	// maxEventSize limits size of single event line
+	maxEventSize = 64 * 1024 * 1024
+	// maxTxnOps is default --max-txn-ops of etcd, range delete is journaled
+	// as delete of every key, so changes of revision could exceed it
+	maxTxnOps = 128
+)
+
+// ErrNotReplayable is wrapped by errors caused by journal content or target,
+// replay of the same journal fails with them every time
+var ErrNotReplayable = errors.New("journal could not be replayed")
+
+// Target is point journal is replayed up to, zero fields are not limited
+type Target struct {
+	Revision int64
+	Time     time.Time
+}
+
+// Reached returns true if event is after target
+func (t Target) Reached(event Event) bool {
+	return (t.Revision > 0 && event.Revision > t.Revision) ||
+		(!t.Time.IsZero() && event.Time.After(t.Time))
+}
+
+// Result describes replayed part of journal
+type Result struct {
+	// Revision is the last applied revision
+	Revision int64
+	// Reached is true if the next change is after target
+	Reached bool
+}
+
+// Replay applies events of segment which follow revision until target is
+// reached, preceding events are only checked not to be after target. Changes
+// of the same revision are applied in transactions of at most maxTxnOps
+// operations. Revision is counted as applied once all its changes are,
+// partially applied revision is safely applied again. Lease of key is
+// journaled, but its TTL is not, so keys are put without leases and never
+// expire
+func Replay(ctx context.Context, etcd *clientv3.Client, r io.Reader, after int64, target Target) (Result, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxEventSize)
+
+	result := Result{
+		Revision: after,
+	}
+	revision := int64(0)
+	var ops []clientv3.Op
+
+	commit := func() error {
+		if len(ops) == 0 {
+			return nil
+		}
+		for len(ops) > 0 {
+			n := len(ops)
+			if n > maxTxnOps {
+				n = maxTxnOps
+			}
+			if _, err := etcd.Txn(ctx).Then(ops[:n]...).Commit(); err != nil {
+				return fmt.Errorf("unable to replay revision %d: %w", revision, err)
+			}
+			ops = ops[n:]
+		}
+		result.Revision = revision
+		ops = nil
+
+		return nil
+	}
+
+	for scanner.Scan() {
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return result, fmt.Errorf("%w: invalid journal event: %v", ErrNotReplayable, err)
+		}
+		if event.Revision <= after {
+			if target.Reached(event) {
+				return result, fmt.Errorf("%w: snapshot already contains change of revision %d made after target", ErrNotReplayable, event.Revision)
+			}
+			continue
+		}
+
+		if event.Revision != revision {
+			if err := commit(); err != nil {
+				return result, err
+			}
+			if target.Reached(event) {
+				result.Reached = true
+				return result, nil
+			}
+			revision = event.Revision
+		}
+
+		switch event.Type {
+		case EventPut:
+			ops = append(ops, clientv3.OpPut(string(event.Key), string(event.Value)))
+		case EventDelete:
+			ops = append(ops, clientv3.OpDelete(string(event.Key)))
+		default:
+			return result, fmt.Errorf("%w: unknown journal event type %q", ErrNotReplayable, event.Type)
+		}
+	}
+	if err := scanner.Err(); errors.Is(err, bufio.ErrTooLong) {
+		return result, fmt.Errorf("%w: %v", ErrNotReplayable, err)
+	} else if err != nil {
+		return result, err
+	}
+
+	return result, commit()
+}
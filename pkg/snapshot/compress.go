@@ -0,0 +1,104 @@
+/*
+Copyright 2022 Evgenii Omelchenko.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3.
+
+This program is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package snapshot
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codecs supported for snapshot compression
+const (
+	CompressionNone = ""
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// Compress returns reader of snapshot compressed with codec
+func Compress(r io.Reader, codec string) (io.ReadCloser, error) {
+	var newWriter func(io.Writer) (io.WriteCloser, error)
+
+	switch codec {
+	case CompressionNone:
+		return io.NopCloser(r), nil
+	case CompressionGzip:
+		newWriter = func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		}
+	case CompressionZstd:
+		newWriter = func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w)
+		}
+	default:
+		return nil, fmt.Errorf("unknown compression codec %q", codec)
+	}
+
+	return pipe(r, newWriter)
+}
+
+// Decompress returns reader of snapshot stored compressed with codec
+func Decompress(r io.Reader, codec string) (io.ReadCloser, error) {
+	switch codec {
+	case CompressionNone:
+		return io.NopCloser(r), nil
+	case CompressionGzip:
+		return gzip.NewReader(r)
+	case CompressionZstd:
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+
+	return nil, fmt.Errorf("unknown compression codec %q", codec)
+}
+
+// pipe returns reader of data from r passed through writer created by newWriter
+func pipe(r io.Reader, newWriter func(io.Writer) (io.WriteCloser, error)) (io.ReadCloser, error) {
+	pr, pw := io.Pipe()
+	w, err := newWriter(pw)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		_, err := io.Copy(w, r)
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+		pw.CloseWithError(err)
+	}()
+
+	return pr, nil
+}
+
+// CountingReader counts bytes read from underlying reader
+type CountingReader struct {
+	io.Reader
+	Count int64
+}
+
+func (r *CountingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.Count += int64(n)
+
+	return n, err
+}
@@ -0,0 +1,125 @@
+/*
+Copyright 2022 Evgenii Omelchenko.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3.
+
+This program is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package snapshot
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("etcd snapshot "), 10000)
+
+	for _, codec := range []string{CompressionNone, CompressionGzip, CompressionZstd} {
+		t.Run(codec, func(t *testing.T) {
+			raw := &CountingReader{Reader: bytes.NewReader(data)}
+			compressed, err := Compress(raw, codec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stored, err := io.ReadAll(compressed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if raw.Count != int64(len(data)) {
+				t.Errorf("counted %d raw bytes, want %d", raw.Count, len(data))
+			}
+			if codec != CompressionNone && len(stored) >= len(data) {
+				t.Errorf("compressed snapshot has %d bytes, raw one has %d", len(stored), len(data))
+			}
+
+			if detected, encrypted := DetectFormat(stored); detected != codec || encrypted {
+				t.Errorf("detected compression %q, encrypted %v", detected, encrypted)
+			}
+
+			decompressed, err := Decompress(bytes.NewReader(stored), codec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer decompressed.Close()
+
+			restored, err := io.ReadAll(decompressed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(restored, data) {
+				t.Error("decompressed snapshot differs from original")
+			}
+		})
+	}
+}
+
+func TestCompressEncrypted(t *testing.T) {
+	data := bytes.Repeat([]byte("etcd snapshot "), 10000)
+
+	compressed, err := Compress(bytes.NewReader(data), CompressionZstd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted := encrypt(t, mustReadAll(t, compressed), testKey(1))
+
+	decrypted, err := Decrypt(bytes.NewReader(encrypted), testKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decompressed, err := Decompress(decrypted, CompressionZstd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decompressed.Close()
+
+	if !bytes.Equal(mustReadAll(t, decompressed), data) {
+		t.Error("decrypted and decompressed snapshot differs from original")
+	}
+}
+
+func TestUnknownCompression(t *testing.T) {
+	if _, err := Compress(bytes.NewReader(nil), "lz4"); err == nil {
+		t.Error("snapshot is compressed by unknown codec")
+	}
+	if _, err := Decompress(bytes.NewReader(nil), "lz4"); err == nil {
+		t.Error("snapshot is decompressed by unknown codec")
+	}
+}
+
+func TestDecompressCorrupted(t *testing.T) {
+	for _, codec := range []string{CompressionGzip, CompressionZstd} {
+		compressed, err := Compress(bytes.NewReader(bytes.Repeat([]byte("etcd"), 1000)), codec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored := mustReadAll(t, compressed)
+
+		decompressed, err := Decompress(bytes.NewReader(stored[:len(stored)/2]), codec)
+		if err != nil {
+			continue
+		}
+		if _, err := io.ReadAll(decompressed); err == nil {
+			t.Errorf("%s: truncated snapshot is decompressed", codec)
+		}
+		decompressed.Close()
+	}
+}
+
+func mustReadAll(t *testing.T, r io.Reader) []byte {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
@@ -0,0 +1,34 @@
+/*
+Copyright 2022 Evgenii Omelchenko.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3.
+
+This program is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package snapshot
+
+import "bytes"
+
+// DetectFormat detects compression codec of stored snapshot by its first
+// bytes. Compression of encrypted snapshot couldn't be detected
+func DetectFormat(header []byte) (compression string, encrypted bool) {
+	switch {
+	case bytes.HasPrefix(header, []byte(encryptionMagic)):
+		return CompressionNone, true
+	case bytes.HasPrefix(header, []byte{0x1f, 0x8b}):
+		return CompressionGzip, false
+	case bytes.HasPrefix(header, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return CompressionZstd, false
+	}
+
+	return CompressionNone, false
+}
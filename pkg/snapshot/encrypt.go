@@ -0,0 +1,235 @@
+/*
+Copyright 2022 Evgenii Omelchenko.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3.
+
+This program is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package snapshot
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Encrypted snapshot starts with magic and random nonce prefix, then chunks
+// of at most chunkSize plaintext bytes follow. Every chunk is sealed with
+// AES-256-GCM using nonce of prefix, chunk counter and last chunk flag, so
+// reordered, truncated or extended streams fail to decrypt.
+const (
+	encryptionMagic = "ETCDOPS\x01"
+	chunkSize       = 64 * 1024
+	prefixSize      = 7
+	headerSize      = 5
+)
+
+var (
+	ErrInvalidKey       = errors.New("encryption key should be 32 bytes long")
+	ErrInvalidEncrypted = errors.New("invalid encrypted snapshot")
+)
+
+// Encrypt returns reader of snapshot encrypted with AES-256-GCM key
+func Encrypt(r io.Reader, key []byte) (io.ReadCloser, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return pipe(r, func(w io.Writer) (io.WriteCloser, error) {
+		ew := &encryptWriter{
+			w:    w,
+			aead: aead,
+		}
+		if _, err := rand.Read(ew.prefix[:]); err != nil {
+			return nil, err
+		}
+
+		return ew, nil
+	})
+}
+
+// Decrypt returns reader of snapshot encrypted with AES-256-GCM key
+func Decrypt(r io.Reader, key []byte) (io.Reader, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, len(encryptionMagic)+prefixSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidEncrypted, err)
+	}
+	if string(header[:len(encryptionMagic)]) != encryptionMagic {
+		return nil, fmt.Errorf("%w: unknown format", ErrInvalidEncrypted)
+	}
+
+	dr := &decryptReader{
+		r:    r,
+		aead: aead,
+	}
+	copy(dr.prefix[:], header[len(encryptionMagic):])
+
+	return dr, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, ErrInvalidKey
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(prefix [prefixSize]byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, prefixSize+5)
+	copy(nonce, prefix[:])
+	binary.BigEndian.PutUint32(nonce[prefixSize:], counter)
+	if last {
+		nonce[prefixSize+4] = 1
+	}
+
+	return nonce
+}
+
+type encryptWriter struct {
+	w         io.Writer
+	aead      cipher.AEAD
+	prefix    [prefixSize]byte
+	counter   uint32
+	buf       []byte
+	headerOut bool
+}
+
+func (w *encryptWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for len(w.buf) > chunkSize {
+		if err := w.flush(w.buf[:chunkSize], false); err != nil {
+			return 0, err
+		}
+		w.buf = w.buf[chunkSize:]
+	}
+
+	return len(p), nil
+}
+
+// Close writes the last chunk, which is emitted even if it is empty
+func (w *encryptWriter) Close() error {
+	return w.flush(w.buf, true)
+}
+
+func (w *encryptWriter) flush(chunk []byte, last bool) error {
+	if !w.headerOut {
+		if _, err := w.w.Write(append([]byte(encryptionMagic), w.prefix[:]...)); err != nil {
+			return err
+		}
+		w.headerOut = true
+	}
+
+	if w.counter == ^uint32(0) {
+		return errors.New("snapshot is too large for encryption")
+	}
+
+	sealed := w.aead.Seal(nil, chunkNonce(w.prefix, w.counter, last), chunk, nil)
+	w.counter++
+
+	header := make([]byte, headerSize)
+	if last {
+		header[0] = 1
+	}
+	binary.BigEndian.PutUint32(header[1:], uint32(len(sealed)))
+
+	if _, err := w.w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.w.Write(sealed)
+
+	return err
+}
+
+type decryptReader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	prefix  [prefixSize]byte
+	counter uint32
+	buf     []byte
+	done    bool
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, r.checkEnd()
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+
+	return n, nil
+}
+
+// checkEnd returns io.EOF if nothing follows the last chunk, data appended
+// to stream is not authenticated, so it is rejected
+func (r *decryptReader) checkEnd() error {
+	var trailing [1]byte
+	n, err := io.ReadFull(r.r, trailing[:])
+	switch {
+	case n > 0:
+		return fmt.Errorf("%w: data after the last chunk", ErrInvalidEncrypted)
+	case err == io.EOF:
+		return io.EOF
+	default:
+		return err
+	}
+}
+
+func (r *decryptReader) next() error {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(r.r, header); err != nil {
+		return fmt.Errorf("%w: truncated stream", ErrInvalidEncrypted)
+	}
+
+	last := header[0] == 1
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > chunkSize+uint32(r.aead.Overhead()) {
+		return fmt.Errorf("%w: chunk is too large", ErrInvalidEncrypted)
+	}
+
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(r.r, sealed); err != nil {
+		return fmt.Errorf("%w: truncated stream", ErrInvalidEncrypted)
+	}
+
+	chunk, err := r.aead.Open(sealed[:0], chunkNonce(r.prefix, r.counter, last), sealed, nil)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidEncrypted, err)
+	}
+
+	r.counter++
+	r.buf = chunk
+	r.done = last
+
+	return nil
+}
@@ -0,0 +1,208 @@
+/*
+Copyright 2022 Evgenii Omelchenko.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3.
+
+This program is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package snapshot
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func testKey(seed byte) []byte {
+	return bytes.Repeat([]byte{seed}, 32)
+}
+
+func testData(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	return data
+}
+
+func encrypt(t *testing.T, data, key []byte) []byte {
+	reader, err := Encrypt(bytes.NewReader(data), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	encrypted, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return encrypted
+}
+
+func decrypt(encrypted, key []byte) ([]byte, error) {
+	reader, err := Decrypt(bytes.NewReader(encrypted), key)
+	if err != nil {
+		return nil, err
+	}
+
+	return io.ReadAll(reader)
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3*chunkSize + 17} {
+		data := testData(size)
+		encrypted := encrypt(t, data, testKey(1))
+
+		if compression, isEncrypted := DetectFormat(encrypted); !isEncrypted || compression != CompressionNone {
+			t.Errorf("size %d: detected compression %q, encrypted %v", size, compression, isEncrypted)
+		}
+		if size > 0 && bytes.Contains(encrypted, data) {
+			t.Errorf("size %d: encrypted snapshot contains plaintext", size)
+		}
+
+		decrypted, err := decrypt(encrypted, testKey(1))
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(decrypted, data) {
+			t.Errorf("size %d: decrypted snapshot differs from original", size)
+		}
+	}
+}
+
+func TestEncryptNonceIsRandom(t *testing.T) {
+	data := testData(100)
+	if bytes.Equal(encrypt(t, data, testKey(1)), encrypt(t, data, testKey(1))) {
+		t.Error("the same snapshot is encrypted into the same bytes twice")
+	}
+}
+
+func TestDecryptInvalid(t *testing.T) {
+	data := testData(2*chunkSize + 100)
+	encrypted := encrypt(t, data, testKey(1))
+	header := len(encryptionMagic) + prefixSize
+	chunk := headerSize + chunkSize + 16
+
+	// swap the first two chunks
+	reordered := append([]byte(nil), encrypted[:header]...)
+	reordered = append(reordered, encrypted[header+chunk:header+2*chunk]...)
+	reordered = append(reordered, encrypted[header:header+chunk]...)
+	reordered = append(reordered, encrypted[header+2*chunk:]...)
+
+	// mark the first chunk as the last one
+	lastFlag := append([]byte(nil), encrypted...)
+	lastFlag[header] = 1
+
+	for _, tc := range []struct {
+		name      string
+		encrypted []byte
+		key       []byte
+	}{{
+		name:      "wrong key",
+		encrypted: encrypted,
+		key:       testKey(2),
+	}, {
+		name:      "tampered chunk",
+		encrypted: flipByte(encrypted, header+headerSize+10),
+		key:       testKey(1),
+	}, {
+		name:      "tampered last chunk",
+		encrypted: flipByte(encrypted, len(encrypted)-1),
+		key:       testKey(1),
+	}, {
+		name:      "tampered nonce prefix",
+		encrypted: flipByte(encrypted, len(encryptionMagic)),
+		key:       testKey(1),
+	}, {
+		name:      "unknown magic",
+		encrypted: flipByte(encrypted, 0),
+		key:       testKey(1),
+	}, {
+		name:      "truncated header",
+		encrypted: encrypted[:header-1],
+		key:       testKey(1),
+	}, {
+		name:      "truncated chunk",
+		encrypted: encrypted[:len(encrypted)-1],
+		key:       testKey(1),
+	}, {
+		name:      "missing last chunk",
+		encrypted: encrypted[:header+2*chunk],
+		key:       testKey(1),
+	}, {
+		name:      "reordered chunks",
+		encrypted: reordered,
+		key:       testKey(1),
+	}, {
+		name:      "forged last chunk flag",
+		encrypted: lastFlag,
+		key:       testKey(1),
+	}, {
+		name:      "trailing data",
+		encrypted: append(append([]byte(nil), encrypted...), 0),
+		key:       testKey(1),
+	}, {
+		name:      "appended stream",
+		encrypted: append(append([]byte(nil), encrypted...), encrypted[header:]...),
+		key:       testKey(1),
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			decrypted, err := decrypt(tc.encrypted, tc.key)
+			if err == nil {
+				t.Fatalf("invalid snapshot is decrypted into %d bytes", len(decrypted))
+			}
+			if !errors.Is(err, ErrInvalidEncrypted) {
+				t.Errorf("error %v is not ErrInvalidEncrypted", err)
+			}
+		})
+	}
+}
+
+func TestEncryptKeyRotation(t *testing.T) {
+	data := testData(chunkSize + 1)
+	oldKey, newKey := testKey(1), testKey(2)
+
+	// snapshots encrypted before rotation are decrypted by the old key only
+	old := encrypt(t, data, oldKey)
+	if _, err := decrypt(old, newKey); err == nil {
+		t.Error("snapshot encrypted by old key is decrypted by new key")
+	}
+	if decrypted, err := decrypt(old, oldKey); err != nil || !bytes.Equal(decrypted, data) {
+		t.Errorf("snapshot encrypted by old key is not decrypted by it: %v", err)
+	}
+
+	rotated := encrypt(t, data, newKey)
+	if _, err := decrypt(rotated, oldKey); err == nil {
+		t.Error("snapshot encrypted by new key is decrypted by old key")
+	}
+	if decrypted, err := decrypt(rotated, newKey); err != nil || !bytes.Equal(decrypted, data) {
+		t.Errorf("snapshot encrypted by new key is not decrypted by it: %v", err)
+	}
+}
+
+func TestInvalidKey(t *testing.T) {
+	for _, size := range []int{0, 16, 31, 33} {
+		if _, err := Encrypt(bytes.NewReader(nil), make([]byte, size)); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("encryption by %d bytes key: %v", size, err)
+		}
+		if _, err := Decrypt(bytes.NewReader(nil), make([]byte, size)); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("decryption by %d bytes key: %v", size, err)
+		}
+	}
+}
+
+func flipByte(data []byte, i int) []byte {
+	flipped := append([]byte(nil), data...)
+	flipped[i] ^= 0xff
+	return flipped
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2022 Evgenii Omelchenko.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3.
+
+This program is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package snapshot
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// keyBucket is bbolt bucket etcd stores revisions of keys in
+const keyBucket = "key"
+
+// Status is hash and revision of snapshot reported by etcdctl snapshot status
+type Status struct {
+	Hash     int64
+	Revision int64
+	TotalKey int
+}
+
+// GetStatus computes snapshot status the same way etcdctl snapshot status
+// does, so it could be compared with status reported by restore verification
+func GetStatus(path string) (*Status, error) {
+	db, err := bolt.Open(path, 0400, &bolt.Options{
+		ReadOnly: true,
+		Timeout:  time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var status Status
+	hash := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	err = db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Cursor()
+		for name, _ := cursor.First(); name != nil; name, _ = cursor.Next() {
+			bucket := tx.Bucket(name)
+			if bucket == nil {
+				return fmt.Errorf("unable to read bucket %s", name)
+			}
+			hash.Write(name)
+
+			isKeyBucket := string(name) == keyBucket
+			if err := bucket.ForEach(func(k, v []byte) error {
+				hash.Write(k)
+				hash.Write(v)
+				// revisions are keys of key bucket, the latest one is the last
+				if isKeyBucket && len(k) >= 8 {
+					status.Revision = int64(binary.BigEndian.Uint64(k[:8]))
+				}
+				status.TotalKey++
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	status.Hash = int64(hash.Sum32())
+	return &status, nil
+}
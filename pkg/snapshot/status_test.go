@@ -0,0 +1,82 @@
+/*
+Copyright 2022 Evgenii Omelchenko.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3.
+
+This program is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package snapshot
+
+import (
+	"encoding/binary"
+	"path/filepath"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func revisionKey(main, sub int64) []byte {
+	key := make([]byte, 17)
+	binary.BigEndian.PutUint64(key, uint64(main))
+	key[8] = '_'
+	binary.BigEndian.PutUint64(key[9:], uint64(sub))
+	return key
+}
+
+func TestGetStatus(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.db")
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		keys, err := tx.CreateBucket([]byte(keyBucket))
+		if err != nil {
+			return err
+		}
+		for _, key := range [][]byte{revisionKey(2, 0), revisionKey(7, 1), revisionKey(5, 0)} {
+			if err := keys.Put(key, []byte("value")); err != nil {
+				return err
+			}
+		}
+		meta, err := tx.CreateBucket([]byte("meta"))
+		if err != nil {
+			return err
+		}
+		return meta.Put([]byte("consistent_index"), []byte{0, 0, 0, 0, 0, 0, 0, 9})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := GetStatus(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Revision != 7 {
+		t.Errorf("revision = %d, want 7", status.Revision)
+	}
+	if status.TotalKey != 4 {
+		t.Errorf("total keys = %d, want 4", status.TotalKey)
+	}
+
+	again, err := GetStatus(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Hash == 0 || again.Hash != status.Hash {
+		t.Errorf("hash = %d, then %d, want the same non zero hash", status.Hash, again.Hash)
+	}
+}
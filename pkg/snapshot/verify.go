@@ -0,0 +1,60 @@
+/*
+Copyright 2022 Evgenii Omelchenko.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3.
+
+This program is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package snapshot
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"os"
+)
+
+var (
+	ErrNoChecksum       = errors.New("snapshot has no integrity checksum")
+	ErrChecksumMismatch = errors.New("snapshot integrity checksum mismatch")
+)
+
+// Verify checks sha256 hash appended by etcd to snapshots received through
+// Maintenance.Snapshot API, the same way etcdctl does on restore
+func Verify(file *os.File) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	size := info.Size()
+	if size%512 != sha256.Size {
+		return ErrNoChecksum
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, io.NewSectionReader(file, 0, size-sha256.Size)); err != nil {
+		return err
+	}
+
+	expected := make([]byte, sha256.Size)
+	if _, err := file.ReadAt(expected, size-sha256.Size); err != nil {
+		return err
+	}
+
+	if !bytes.Equal(hash.Sum(nil), expected) {
+		return ErrChecksumMismatch
+	}
+
+	return nil
+}
@@ -0,0 +1,167 @@
+/*
+Copyright 2022 Evgenii Omelchenko.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3.
+
+This program is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const tempSuffix = ".tmp"
+
+// FileStorage stores backups in local directory, e.g. mounted PVC
+type FileStorage struct {
+	Root string
+}
+
+var _ BackupStorage = &FileStorage{}
+
+func (s *FileStorage) Upload(ctx context.Context, key string, body io.Reader, _ UploadOptions) (string, error) {
+	name := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(name), 0o750); err != nil {
+		return "", err
+	}
+
+	file, err := os.Create(name + tempSuffix)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := io.Copy(file, &contextReader{ctx: ctx, r: body}); err != nil {
+		file.Close()
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(file.Name(), name); err != nil {
+		return "", err
+	}
+
+	return s.URL(key), nil
+}
+
+func (s *FileStorage) URL(key string) string {
+	return "file://" + s.path(key)
+}
+
+// LockUntil implements BackupStorage, files are never locked
+func (s *FileStorage) LockUntil(time.Time, time.Duration) time.Time {
+	return time.Time{}
+}
+
+func (s *FileStorage) Download(ctx context.Context, key string) (io.ReadCloser, error) {
+	file, err := os.Open(s.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+
+	return file, err
+}
+
+func (s *FileStorage) Delete(ctx context.Context, key string) error {
+	err := os.Remove(s.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
+
+func (s *FileStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+
+	err := filepath.WalkDir(s.path(prefix), func(name string, entry fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil || entry.IsDir() || strings.HasSuffix(name, tempSuffix) {
+			return err
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		key, err := filepath.Rel(s.Root, name)
+		if err != nil {
+			return err
+		}
+
+		objects = append(objects, ObjectInfo{
+			Key:          filepath.ToSlash(key),
+			Size:         info.Size(),
+			LastModified: info.ModTime(),
+		})
+		return nil
+	})
+
+	return objects, err
+}
+
+func (s *FileStorage) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	info, err := os.Stat(s.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &ObjectInfo{
+		Key:          key,
+		Size:         info.Size(),
+		LastModified: info.ModTime(),
+	}, nil
+}
+
+// Check implements BackupStorage, it fails if root is not a directory
+func (s *FileStorage) Check(ctx context.Context) error {
+	info, err := os.Stat(s.Root)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", s.Root)
+	}
+
+	return nil
+}
+
+func (s *FileStorage) path(key string) string {
+	return filepath.Join(s.Root, filepath.FromSlash(filepath.Clean("/"+key)))
+}
+
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return r.r.Read(p)
+}
@@ -0,0 +1,294 @@
+/*
+Copyright 2022 Evgenii Omelchenko.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3.
+
+This program is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// S3Config describes connection to a bucket of S3 compatible storage,
+// ambient AWS credentials are used if Credentials are not set
+type S3Config struct {
+	Endpoint       string
+	Region         string
+	Bucket         string
+	Prefix         string
+	ForcePathStyle bool
+	Credentials    *credentials.Credentials
+
+	// StorageClass of uploaded objects, bucket default is used if it is
+	// not set
+	StorageClass string
+	// ServerSideEncryption is either AES256 or aws:kms
+	ServerSideEncryption string
+	// KMSKeyID is ID of KMS key used by aws:kms server-side encryption
+	KMSKeyID string
+	Tags     map[string]string
+	// ObjectLockMode is either GOVERNANCE or COMPLIANCE, uploaded objects
+	// are not locked if it is not set
+	ObjectLockMode string
+	// ObjectLockRetention is lock duration of objects uploaded without
+	// explicit retention
+	ObjectLockRetention time.Duration
+}
+
+// S3Storage stores backups in S3 bucket under specified prefix
+type S3Storage struct {
+	S3Config
+	API      s3iface.S3API
+	Uploader *s3manager.Uploader
+}
+
+var _ BackupStorage = &S3Storage{}
+
+func NewS3Storage(config S3Config) (*S3Storage, error) {
+	awsConfig := &aws.Config{
+		S3ForcePathStyle: aws.Bool(config.ForcePathStyle),
+		Credentials:      config.Credentials,
+	}
+	if config.Endpoint != "" {
+		awsConfig.Endpoint = aws.String(config.Endpoint)
+	}
+	if config.Region != "" {
+		awsConfig.Region = aws.String(config.Region)
+	}
+
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return &S3Storage{
+		S3Config: config,
+		API:      s3.New(sess),
+		Uploader: s3manager.NewUploader(sess),
+	}, nil
+}
+
+func (s *S3Storage) Upload(ctx context.Context, key string, body io.Reader, options UploadOptions) (string, error) {
+	input := &s3manager.UploadInput{
+		Bucket: &s.Bucket,
+		Key:    aws.String(s.objectKey(key)),
+		Body:   body,
+	}
+	if s.StorageClass != "" {
+		input.StorageClass = aws.String(s.StorageClass)
+	}
+	if s.ServerSideEncryption != "" {
+		input.ServerSideEncryption = aws.String(s.ServerSideEncryption)
+	}
+	if s.KMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(s.KMSKeyID)
+	}
+	if len(s.Tags) > 0 {
+		tags := url.Values{}
+		for key, value := range s.Tags {
+			tags.Set(key, value)
+		}
+		input.Tagging = aws.String(tags.Encode())
+	}
+	// lock couldn't be set in the past
+	if s.ObjectLockMode != "" && options.RetainUntil.After(time.Now()) {
+		input.ObjectLockMode = aws.String(s.ObjectLockMode)
+		input.ObjectLockRetainUntilDate = aws.Time(options.RetainUntil)
+	}
+
+	output, err := s.Uploader.UploadWithContext(ctx, input)
+	if err != nil {
+		return "", err
+	}
+
+	return output.Location, nil
+}
+
+func (s *S3Storage) Download(ctx context.Context, key string) (io.ReadCloser, error) {
+	output, err := s.API.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: &s.Bucket,
+		Key:    aws.String(s.objectKey(key)),
+	})
+	if err != nil {
+		return nil, convertError(err)
+	}
+
+	return output.Body, nil
+}
+
+// Delete removes object, all versions of object are removed from buckets with
+// object lock since they are always versioned
+func (s *S3Storage) Delete(ctx context.Context, key string) error {
+	if s.ObjectLockMode != "" {
+		return s.deleteVersions(ctx, key)
+	}
+
+	_, err := s.API.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: &s.Bucket,
+		Key:    aws.String(s.objectKey(key)),
+	})
+
+	return convertError(err)
+}
+
+func (s *S3Storage) deleteVersions(ctx context.Context, key string) error {
+	objectKey := s.objectKey(key)
+
+	var versions []*string
+	err := s.API.ListObjectVersionsPagesWithContext(ctx, &s3.ListObjectVersionsInput{
+		Bucket: &s.Bucket,
+		Prefix: &objectKey,
+	}, func(page *s3.ListObjectVersionsOutput, _ bool) bool {
+		for _, version := range page.Versions {
+			if aws.StringValue(version.Key) == objectKey {
+				versions = append(versions, version.VersionId)
+			}
+		}
+		for _, marker := range page.DeleteMarkers {
+			if aws.StringValue(marker.Key) == objectKey {
+				versions = append(versions, marker.VersionId)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return convertError(err)
+	}
+
+	for _, version := range versions {
+		if _, err := s.API.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+			Bucket:    &s.Bucket,
+			Key:       &objectKey,
+			VersionId: version,
+		}); err != nil {
+			return convertError(err)
+		}
+	}
+
+	return nil
+}
+
+func (s *S3Storage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+
+	listPrefix := s.objectKey(prefix)
+	if listPrefix != "" {
+		listPrefix += "/"
+	}
+
+	err := s.API.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: &s.Bucket,
+		Prefix: &listPrefix,
+	}, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		for _, object := range page.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:          s.storageKey(aws.StringValue(object.Key)),
+				Size:         aws.Int64Value(object.Size),
+				LastModified: aws.TimeValue(object.LastModified),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, convertError(err)
+	}
+
+	return objects, nil
+}
+
+func (s *S3Storage) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	output, err := s.API.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: &s.Bucket,
+		Key:    aws.String(s.objectKey(key)),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NotFound" {
+		// HeadObject has no body to tell missing key from missing bucket
+		if err := s.Check(ctx); err != nil {
+			return nil, err
+		}
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, convertError(err)
+	}
+
+	return &ObjectInfo{
+		Key:          key,
+		Size:         aws.Int64Value(output.ContentLength),
+		LastModified: aws.TimeValue(output.LastModified),
+	}, nil
+}
+
+// Check implements BackupStorage, it fails if bucket does not exist or is
+// not accessible with configured credentials
+func (s *S3Storage) Check(ctx context.Context) error {
+	_, err := s.API.HeadBucketWithContext(ctx, &s3.HeadBucketInput{
+		Bucket: &s.Bucket,
+	})
+
+	return err
+}
+
+func (s *S3Storage) URL(key string) string {
+	return "s3://" + path.Join(s.Bucket, s.objectKey(key))
+}
+
+func (s *S3Storage) LockUntil(created time.Time, retention time.Duration) time.Time {
+	if s.ObjectLockMode == "" {
+		return time.Time{}
+	}
+	if retention <= 0 {
+		retention = s.ObjectLockRetention
+	}
+	if retention <= 0 {
+		return time.Time{}
+	}
+
+	return created.Add(retention)
+}
+
+func (s *S3Storage) objectKey(key string) string {
+	return strings.TrimPrefix(path.Join(s.Prefix, key), "/")
+}
+
+func (s *S3Storage) storageKey(objectKey string) string {
+	if s.Prefix == "" {
+		return objectKey
+	}
+
+	return strings.TrimPrefix(objectKey, strings.Trim(s.Prefix, "/")+"/")
+}
+
+func convertError(err error) error {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case s3.ErrCodeNoSuchKey:
+			return ErrNotFound
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2022 Evgenii Omelchenko.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3.
+
+This program is distributed in the hope that it will be useful, but
+WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ErrNotFound is returned when requested object is absent in storage
+var ErrNotFound = errors.New("object not found")
+
+// ObjectInfo describes an object stored in backup storage
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+// UploadOptions describe how uploaded object is stored
+type UploadOptions struct {
+	// RetainUntil is time object is locked against deletion until, it is
+	// ignored by storages without object locks
+	RetainUntil time.Time
+}
+
+// BackupStorage is a place where backup snapshots are stored by keys
+type BackupStorage interface {
+	// Upload stores body under key and returns URL of created object
+	Upload(ctx context.Context, key string, body io.Reader, options UploadOptions) (string, error)
+	Download(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+	// List returns objects which keys are placed under prefix
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+	Stat(ctx context.Context, key string) (*ObjectInfo, error)
+	// Check returns error if storage itself, e.g. bucket, is not accessible
+	Check(ctx context.Context) error
+	// URL returns URL of object stored under key
+	URL(key string) string
+	// LockUntil returns time object created at given time should be locked
+	// against deletion until, zero time is returned if objects are not
+	// locked. Retention is used if it is set, otherwise storage default is
+	LockUntil(created time.Time, retention time.Duration) time.Time
+}
+
+// Registry holds backup storages configured for the operator
+type Registry struct {
+	Default  string
+	Storages map[string]BackupStorage
+	// CredentialsSecrets are names of secrets with credentials of storages,
+	// they are looked up in namespace of pods fetching backups
+	CredentialsSecrets map[string]string
+}
+
+func (r *Registry) Get(name string) (BackupStorage, error) {
+	if name == "" {
+		name = r.Default
+	}
+
+	storage, ok := r.Storages[name]
+	if !ok {
+		return nil, fmt.Errorf("backup storage %q is not configured", name)
+	}
+
+	return storage, nil
+}
+
+// GetCredentialsSecret returns name of secret with credentials of storage,
+// it is empty if storage has no such secret
+func (r *Registry) GetCredentialsSecret(name string) string {
+	if name == "" {
+		name = r.Default
+	}
+
+	return r.CredentialsSecrets[name]
+}